@@ -0,0 +1,306 @@
+// Copyright 2019 Michael J. Fromberger. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ffuse
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"syscall"
+
+	"github.com/creachadair/ffs/file/root"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// Control configures a virtual control directory in the root of the tree, so
+// that programs using the filesystem can inspect and control it. The control
+// directory is not listed in the root, and hides any file of the same name.
+//
+// The control directory contains these read-only files:
+//
+//	rootKey    -- the name of the root pointer for the tree, if any
+//	status     -- whether the tree has changes not yet flushed, and if not,
+//	              the storage key of the root (in hex); the tree is clean if
+//	              its root matches the root pointer named by RootKey, or if
+//	              there is none, the key of the last flush by the control
+//	              directory
+//	stats      -- the number of files and bytes of data in the tree, as of
+//	              its last flush
+//	config     -- the settings of the filesystem
+//
+// Reading them does not flush the tree. The control directory also contains
+// these write-only files, which perform a command when written by the owner
+// of the root of the tree:
+//
+//	flush      -- flush the tree to storage
+//	snapshot   -- flush the tree and write a root pointer for it, as for the
+//	              ffs.snapshot attribute of a directory
+//	readonly   -- flush the tree and refuse any further changes
+type Control struct {
+	// Name is the name of the control directory, for example ".ffs".
+	Name string
+
+	// RootKey is the name of the root pointer from which the tree was loaded,
+	// if any.
+	RootKey string
+
+	// Flush, if non-nil, is called to flush the tree, and reports the storage
+	// key of the root. If nil, the root file is flushed directly.
+	Flush func(context.Context) (string, error)
+}
+
+// controlNode returns the node for the control directory, if name is the
+// name of the control directory and f is the root of the tree. Otherwise it
+// returns nil.
+func (f *FS) controlNode(ctx context.Context, name string) *fs.Inode {
+	if !f.isControlName(name) {
+		return nil
+	}
+	f.st.mu.Lock()
+	defer f.st.mu.Unlock()
+	if f.st.ctl == nil {
+		c := &ctlNode{root: f, mode: syscall.S_IFDIR | 0555}
+		in := f.NewPersistentInode(ctx, c, fs.StableAttr{Mode: syscall.S_IFDIR})
+		for _, cf := range f.controlFiles() {
+			cf.root = f
+			in.AddChild(cf.name, in.NewPersistentInode(ctx, cf, fs.StableAttr{Mode: syscall.S_IFREG}), false)
+		}
+		f.st.ctl = in
+	}
+	return f.st.ctl
+}
+
+// isControlName reports whether name is the name of the control directory in
+// the directory f.
+func (f *FS) isControlName(name string) bool {
+	c := f.st.opts.Control
+	return c != nil && c.Name != "" && name == c.Name && f.IsRoot()
+}
+
+// controlFiles returns new nodes for the files of the control directory of
+// the root f.
+func (f *FS) controlFiles() []*ctlNode {
+	return []*ctlNode{
+		{name: "rootKey", read: func(ctx context.Context) ([]byte, error) {
+			return fmt.Appendf(nil, "%s\n", f.st.opts.Control.RootKey), nil
+		}},
+		{name: "status", read: func(ctx context.Context) ([]byte, error) {
+			key, ok := f.st.currentKey()
+			if !ok {
+				return []byte("dirty\n"), nil
+			}
+			if saved, err := f.st.flushedKey(ctx); err != nil {
+				return nil, err
+			} else if key != saved {
+				return []byte("dirty\n"), nil
+			}
+			return fmt.Appendf(nil, "clean %s\n", hex.EncodeToString([]byte(key))), nil
+		}},
+		{name: "stats", read: func(ctx context.Context) ([]byte, error) {
+			u, err := f.st.treeUsage(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return fmt.Appendf(nil, "files %d\nbytes %d\n", u.files+u.dirs, u.bytes), nil
+		}},
+		{name: "config", read: func(ctx context.Context) ([]byte, error) {
+			o := &f.st.opts
+			return fmt.Appendf(nil, "readOnly %v\nstrictPermissions %v\natime %s\nlistVirtualXAttrs %v\n",
+				f.st.readOnly.Load(), o.StrictPermissions, o.Atime, o.ListVirtualXAttrs), nil
+		}},
+		{name: "flush", write: func(ctx context.Context, _ []byte) errno {
+			return f.st.flush(ctx)
+		}},
+		{name: "snapshot", write: func(ctx context.Context, data []byte) errno {
+			return f.snapshot(ctx, data, 0)
+		}},
+		{name: "readonly", write: func(ctx context.Context, _ []byte) errno {
+			if e := f.st.flush(ctx); e != noError {
+				return e
+			}
+			f.st.readOnly.Store(true)
+			return noError
+		}},
+	}
+}
+
+// flush flushes the tree to storage.
+func (s *fsState) flush(ctx context.Context) errno {
+	s.mu.Lock()
+	n := s.changes
+	s.mu.Unlock()
+
+	var key string
+	var err error
+	if c := s.opts.Control; c != nil && c.Flush != nil {
+		key, err = c.Flush(ctx)
+	} else {
+		key, err = s.root.Flush(ctx)
+	}
+	if err != nil {
+		return errorToErrno(err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.flushed = key
+	if s.changes == n {
+		s.staleKey = "" // the flush covers every change begun
+	}
+	return noError
+}
+
+// noteChange records that a change to the tree is about to be made.
+//
+// The storage key of the root is not cleared when a file below it changes, so
+// the key the root has when the change is made is recorded as stale. Flushing
+// the change gives the root a new key. A change that fails leaves the key
+// stale until the tree is next flushed by the control directory.
+func (s *fsState) noteChange() {
+	key := s.root.Key()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.changes++
+	s.staleKey = key
+}
+
+// currentKey returns the storage key of the root, and reports whether the
+// tree is known to be unchanged since it was flushed with that key. It does
+// not flush the tree.
+func (s *fsState) currentKey() (string, bool) {
+	key := s.root.Key()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return key, key != "" && key != s.staleKey
+}
+
+// flushedKey returns the storage key of the root as last recorded: the file
+// key of the root pointer named by the control directory, if there is one,
+// or otherwise the key of the last flush by the control directory.
+func (s *fsState) flushedKey(ctx context.Context) (string, error) {
+	if c := s.opts.Control; c != nil && c.RootKey != "" && s.opts.Store.IsValid() {
+		rp, err := root.Open(ctx, s.opts.Store.Roots(), c.RootKey)
+		if err != nil {
+			return "", err
+		}
+		return rp.FileKey, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.flushed, nil
+}
+
+// A ctlNode is a node of the control directory. The directory itself has
+// neither read nor write functions.
+type ctlNode struct {
+	fs.Inode
+
+	root  *FS // the root of the tree
+	name  string
+	mode  uint32
+	read  func(context.Context) ([]byte, error) // contents of a readable file
+	write func(context.Context, []byte) errno   // command of a writable file
+}
+
+// Verify that ctlNode supports interfaces required by the FUSE integration.
+var (
+	_ fs.NodeGetattrer = (*ctlNode)(nil)
+	_ fs.NodeOpener    = (*ctlNode)(nil)
+	_ fs.NodeSetattrer = (*ctlNode)(nil)
+	_ fs.NodeWriter    = (*ctlNode)(nil)
+)
+
+// Getattr implements the [fs.NodeGetattrer] interface.
+func (c *ctlNode) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) errno {
+	mode := c.mode
+	switch {
+	case c.read != nil:
+		mode = syscall.S_IFREG | 0444
+	case c.write != nil:
+		mode = syscall.S_IFREG | 0200
+	}
+	s := c.root.file().Stat()
+	out.Mode = mode
+	out.Nlink = 1
+	if mode&syscall.S_IFMT == syscall.S_IFDIR {
+		out.Nlink = 2
+	}
+	out.Owner.Uid = uint32(s.OwnerID)
+	out.Owner.Gid = uint32(s.GroupID)
+	setAttrTime(&out.Mtime, &out.Mtimensec, s.ModTime)
+	return noError
+}
+
+// ctlTruncateMask is the set of attributes that may accompany a truncation of
+// a command file of the control directory.
+const ctlTruncateMask = fuse.FATTR_SIZE | fuse.FATTR_FH | fuse.FATTR_LOCKOWNER |
+	fuse.FATTR_MTIME | fuse.FATTR_MTIME_NOW | fuse.FATTR_CTIME
+
+// Setattr implements the [fs.NodeSetattrer] interface. It permits truncating a
+// command file to zero length, as the shell does when redirecting output to
+// it, but this has no effect. Any other change is refused.
+func (c *ctlNode) Setattr(ctx context.Context, fh fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) errno {
+	if size, ok := in.GetSize(); c.write == nil || !ok || size != 0 || in.Valid&^ctlTruncateMask != 0 {
+		return syscall.EPERM
+	}
+	return c.Getattr(ctx, fh, out)
+}
+
+// Open implements the [fs.NodeOpener] interface.
+func (c *ctlNode) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, errno) {
+	if isReadOnly(flags) {
+		if c.read == nil {
+			return nil, 0, syscall.EACCES
+		}
+		data, err := c.read(ctx)
+		if err != nil {
+			return nil, 0, errorToErrno(err)
+		}
+		// The contents are generated when the file is opened, so the kernel
+		// must not cache them or rely on the reported size.
+		return ctlHandle(data), fuse.FOPEN_DIRECT_IO, noError
+	} else if c.write == nil || flags&syscall.O_ACCMODE != syscall.O_WRONLY {
+		return nil, 0, syscall.EACCES
+	} else if e := c.root.checkOwner(ctx); e != noError {
+		return nil, 0, e
+	}
+	return nil, fuse.FOPEN_DIRECT_IO, noError
+}
+
+// Write implements the [fs.NodeWriter] interface. Each write to a command
+// file performs the command, with the data as its argument.
+func (c *ctlNode) Write(ctx context.Context, fh fs.FileHandle, data []byte, off int64) (uint32, errno) {
+	if c.write == nil {
+		return 0, syscall.EBADF
+	}
+	if e := c.write(ctx, bytes.TrimSpace(data)); e != noError {
+		return 0, e
+	}
+	return uint32(len(data)), noError
+}
+
+// A ctlHandle is an open readable file of the control directory.
+type ctlHandle []byte
+
+var _ fs.FileReader = ctlHandle(nil)
+
+// Read implements the [fs.FileReader] interface.
+func (h ctlHandle) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, errno) {
+	if off >= int64(len(h)) {
+		return fuse.ReadResultData(nil), noError
+	}
+	return fuse.ReadResultData(h[off:min(off+int64(len(dest)), int64(len(h)))]), noError
+}
@@ -0,0 +1,243 @@
+// Copyright 2019 Michael J. Fromberger. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ffuse_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/creachadair/ffs/blob/memstore"
+	"github.com/creachadair/ffs/file"
+	"github.com/creachadair/ffs/file/root"
+	"github.com/creachadair/ffs/filetree"
+	"github.com/creachadair/ffuse"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// controlFile returns the node of the named file of the control directory.
+func controlFile(t *testing.T, ctx context.Context, root *ffuse.FS, name string) *fs.Inode {
+	t.Helper()
+	dir, e := root.Lookup(ctx, ".ffs", new(fuse.EntryOut))
+	if e != 0 {
+		t.Fatalf("Lookup .ffs: %v", e)
+	}
+	in := dir.GetChild(name)
+	if in == nil {
+		t.Fatalf("Control file %q not found", name)
+	}
+	return in
+}
+
+// readControl returns the contents of the named file of the control directory.
+func readControl(t *testing.T, ctx context.Context, root *ffuse.FS, name string) string {
+	t.Helper()
+	fh, _, e := controlFile(t, ctx, root, name).Operations().(fs.NodeOpener).Open(ctx, syscall.O_RDONLY)
+	if e != 0 {
+		t.Fatalf("Open %q: %v", name, e)
+	}
+	buf := make([]byte, 4096)
+	rr, e := fh.(fs.FileReader).Read(ctx, buf, 0)
+	if e != 0 {
+		t.Fatalf("Read %q: %v", name, e)
+	}
+	data, _ := rr.Bytes(buf)
+	return string(data)
+}
+
+// writeControl writes data to the named file of the control directory.
+func writeControl(t *testing.T, ctx context.Context, root *ffuse.FS, name, data string) syscall.Errno {
+	t.Helper()
+	node := controlFile(t, ctx, root, name).Operations()
+	if _, _, e := node.(fs.NodeOpener).Open(ctx, syscall.O_WRONLY); e != 0 {
+		return e
+	}
+	_, e := node.(fs.NodeWriter).Write(ctx, nil, []byte(data), 0)
+	return e
+}
+
+func TestControlStatus(t *testing.T) {
+	root, ctx := newTestFSOptions(t, &ffuse.Options{Control: &ffuse.Control{Name: ".ffs"}})
+	if got := readControl(t, ctx, root, "status"); got != "dirty\n" {
+		t.Errorf("Status before flush: got %q, want dirty", got)
+	}
+	if e := writeControl(t, ctx, root, "flush", "\n"); e != 0 {
+		t.Fatalf("Write flush: %v", e)
+	}
+	if got := readControl(t, ctx, root, "status"); !strings.HasPrefix(got, "clean ") {
+		t.Errorf("Status after flush: got %q, want clean", got)
+	}
+
+	// A change below the root makes the tree dirty, although the root itself
+	// still has a storage key.
+	sub := makeDir(t, ctx, root, "sub")
+	if e := writeControl(t, ctx, root, "flush", "\n"); e != 0 {
+		t.Fatalf("Write flush: %v", e)
+	}
+	createFile(t, ctx, sub, "file", "data")
+	if got := readControl(t, ctx, root, "status"); got != "dirty\n" {
+		t.Errorf("Status after change: got %q, want dirty", got)
+	}
+
+	// Reading the status and statistics does not flush the tree.
+	if got, want := readControl(t, ctx, root, "stats"), "files 2\nbytes 0\n"; got != want {
+		t.Errorf("Stats before flush: got %q, want %q", got, want)
+	}
+	if got := readControl(t, ctx, root, "status"); got != "dirty\n" {
+		t.Errorf("Status after reading stats: got %q, want dirty", got)
+	}
+	if e := writeControl(t, ctx, root, "flush", "\n"); e != 0 {
+		t.Fatalf("Write flush: %v", e)
+	}
+	if got, want := readControl(t, ctx, root, "stats"), "files 3\nbytes 4\n"; got != want {
+		t.Errorf("Stats: got %q, want %q", got, want)
+	}
+	if got := readControl(t, ctx, root, "status"); !strings.HasPrefix(got, "clean ") {
+		t.Errorf("Status after flush: got %q, want clean", got)
+	}
+}
+
+func TestControlOwner(t *testing.T) {
+	root, ctx := newTestFSOptions(t, &ffuse.Options{
+		StrictPermissions: true,
+		Control:           &ffuse.Control{Name: ".ffs"},
+	})
+	chown := &fuse.SetAttrIn{SetAttrInCommon: fuse.SetAttrInCommon{
+		Valid: fuse.FATTR_UID | fuse.FATTR_GID, Owner: fuse.Owner{Uid: 1000, Gid: 1000},
+	}}
+	if e := setattr(asUser(ctx, 0, 0), root, chown); e != 0 {
+		t.Fatalf("Setattr owner: %v", e)
+	}
+	var out fuse.AttrOut
+	if e := controlFile(t, ctx, root, "flush").Operations().(fs.NodeGetattrer).Getattr(ctx, nil, &out); e != 0 {
+		t.Fatalf("Getattr flush: %v", e)
+	} else if got, want := out.Mode, uint32(syscall.S_IFREG|0200); got != want {
+		t.Errorf("Getattr flush: got mode %o, want %o", got, want)
+	}
+
+	// Only the owner of the root, or the superuser, may perform a command.
+	for _, name := range []string{"flush", "snapshot", "readonly"} {
+		if e := writeControl(t, asUser(ctx, 2000, 2000), root, name, "x"); e != syscall.EPERM {
+			t.Errorf("Write %q as another user: got %v, want %v", name, e, syscall.EPERM)
+		}
+	}
+	if got := readControl(t, ctx, root, "config"); !strings.Contains(got, "readOnly false\n") {
+		t.Errorf("Config: got %q, want readOnly false", got)
+	}
+	if e := writeControl(t, ctx, root, "flush", ""); e != 0 {
+		t.Errorf("Write flush as owner: %v", e)
+	}
+	if e := writeControl(t, asUser(ctx, 0, 0), root, "flush", ""); e != 0 {
+		t.Errorf("Write flush as root: %v", e)
+	}
+}
+
+func TestControlSetattr(t *testing.T) {
+	root, ctx := newTestFSOptions(t, &ffuse.Options{Control: &ffuse.Control{Name: ".ffs"}})
+	setattr := func(name string, in *fuse.SetAttrIn) syscall.Errno {
+		node := controlFile(t, ctx, root, name).Operations().(fs.NodeSetattrer)
+		return node.Setattr(ctx, nil, in, new(fuse.AttrOut))
+	}
+	truncate := &fuse.SetAttrIn{SetAttrInCommon: fuse.SetAttrInCommon{
+		Valid: fuse.FATTR_SIZE | fuse.FATTR_MTIME | fuse.FATTR_MTIME_NOW | fuse.FATTR_CTIME,
+	}}
+	if e := setattr("flush", truncate); e != 0 {
+		t.Errorf("Truncate flush: got %v, want success", e)
+	}
+	for _, tc := range []struct {
+		name string
+		in   fuse.SetAttrInCommon
+	}{
+		{"status", fuse.SetAttrInCommon{Valid: fuse.FATTR_SIZE}},
+		{"flush", fuse.SetAttrInCommon{Valid: fuse.FATTR_SIZE, Size: 5}},
+		{"flush", fuse.SetAttrInCommon{Valid: fuse.FATTR_MODE, Mode: 0777}},
+		{"flush", fuse.SetAttrInCommon{Valid: fuse.FATTR_UID | fuse.FATTR_GID}},
+		{"flush", fuse.SetAttrInCommon{Valid: fuse.FATTR_ATIME | fuse.FATTR_MTIME}},
+	} {
+		if e := setattr(tc.name, &fuse.SetAttrIn{SetAttrInCommon: tc.in}); e != syscall.EPERM {
+			t.Errorf("Setattr %q valid=%#x: got %v, want %v", tc.name, tc.in.Valid, e, syscall.EPERM)
+		}
+	}
+}
+
+func TestControlReadOnly(t *testing.T) {
+	root, ctx := newTestFSOptions(t, &ffuse.Options{Control: &ffuse.Control{Name: ".ffs"}})
+	createFile(t, ctx, root, "before", "ok")
+	if e := writeControl(t, ctx, root, "readonly", "1"); e != 0 {
+		t.Fatalf("Write readonly: %v", e)
+	}
+	if got := readControl(t, ctx, root, "status"); !strings.HasPrefix(got, "clean ") {
+		t.Errorf("Status: got %q, want clean", got)
+	}
+	if got := readControl(t, ctx, root, "config"); !strings.Contains(got, "readOnly true\n") {
+		t.Errorf("Config: got %q, want readOnly true", got)
+	}
+	if _, _, _, e := root.Create(ctx, "after", syscall.O_CREAT|syscall.O_WRONLY, 0644, new(fuse.EntryOut)); e != syscall.EROFS {
+		t.Errorf("Create after readonly: got %v, want %v", e, syscall.EROFS)
+	}
+	if _, e := root.Mkdir(ctx, "dir", 0755, new(fuse.EntryOut)); e != syscall.EROFS {
+		t.Errorf("Mkdir after readonly: got %v, want %v", e, syscall.EROFS)
+	}
+	if e := root.Unlink(ctx, "before"); e != syscall.EROFS {
+		t.Errorf("Unlink after readonly: got %v, want %v", e, syscall.EROFS)
+	}
+
+	// The status and other readable files cannot be written.
+	if e := writeControl(t, ctx, root, "status", "x"); e != syscall.EACCES {
+		t.Errorf("Write status: got %v, want %v", e, syscall.EACCES)
+	}
+}
+
+func TestControlStatusRootKey(t *testing.T) {
+	st, err := filetree.NewStore(t.Context(), memstore.New(nil))
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+	rf := file.New(st.Files(), &file.NewOptions{Stat: &file.Stat{Mode: os.ModeDir | 0755}})
+	key, err := rf.Flush(t.Context())
+	if err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if err := root.New(st.Roots(), &root.Options{FileKey: key}).Save(t.Context(), "test"); err != nil {
+		t.Fatalf("Save root: %v", err)
+	}
+
+	// The tree is clean if it matches the root pointer, however it got there.
+	ctl := &ffuse.Control{Name: ".ffs", RootKey: "test"}
+	fsys := ffuse.New(rf, &ffuse.Options{Store: st, Control: ctl})
+	fs.NewNodeFS(fsys, &fs.Options{})
+	ctx := fuse.NewContext(t.Context(), &fuse.Caller{Owner: fuse.Owner{Uid: 1000, Gid: 1000}})
+	if got := readControl(t, ctx, fsys, "status"); got != fmt.Sprintf("clean %x\n", key) {
+		t.Errorf("Status: got %q, want clean", got)
+	}
+	createFile(t, ctx, fsys, "file", "data")
+	if got := readControl(t, ctx, fsys, "status"); got != "dirty\n" {
+		t.Errorf("Status after change: got %q, want dirty", got)
+	}
+	nkey, err := rf.Flush(ctx)
+	if err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if err := root.New(st.Roots(), &root.Options{FileKey: nkey}).Save(ctx, "test"); err != nil {
+		t.Fatalf("Save root: %v", err)
+	}
+	if got := readControl(t, ctx, fsys, "status"); got != fmt.Sprintf("clean %x\n", nkey) {
+		t.Errorf("Status after saving root: got %q, want clean", got)
+	}
+}
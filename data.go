@@ -0,0 +1,323 @@
+// Copyright 2019 Michael J. Fromberger. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ffuse
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/creachadair/ffs/block"
+	"github.com/creachadair/ffs/file"
+	"github.com/creachadair/ffs/file/wiretype"
+)
+
+// A dataBlock records the location and storage key of a stored block of file
+// data. Ranges of a file not covered by any block are unstored zeroes.
+type dataBlock struct {
+	base, bytes int64
+	key         []byte
+}
+
+func (b dataBlock) end() int64 { return b.base + b.bytes }
+
+// A dataLayout records which ranges of the data of a file are stored.
+type dataLayout struct {
+	file   *file.File
+	key    string     // the storage key of file when recorded, if clean
+	hash   string     // the data hash of file when recorded
+	spans  []dataSpan // stored ranges, in order of offset
+	size   int64      // total size of the file in bytes
+	stored int64      // total bytes of stored data
+}
+
+// A dataSpan is a range of a file covered by adjacent stored blocks.
+type dataSpan struct{ base, end int64 }
+
+// layout returns the layout of the data of the file served by f. The layout is
+// cached, and is computed again only when the data of the file change.
+func (f *FS) layout() *dataLayout {
+	// Record the key, size, and hash before reading the blocks, so that a
+	// concurrent change cannot be missed by a later check.
+	cf := f.file()
+	key, size := cf.Key(), cf.Data().Size()
+	f.mu.Lock()
+	cur := f.dlayout
+	f.mu.Unlock()
+	if cur != nil && cur.file == cf && cur.size == size && key != "" && cur.key == key {
+		return cur
+	}
+	hash := string(cf.Data().Hash())
+	if cur != nil && cur.file == cf && cur.size == size && cur.hash == hash {
+		return cur
+	}
+
+	blks, _ := dataBlocks(cf)
+	l := &dataLayout{file: cf, key: key, hash: hash, size: size}
+	for _, b := range blks {
+		l.stored += b.bytes
+		if n := len(l.spans); n > 0 && l.spans[n-1].end == b.base {
+			l.spans[n-1].end = b.end()
+		} else {
+			l.spans = append(l.spans, dataSpan{base: b.base, end: b.end()})
+		}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.dlayout = l
+	return l
+}
+
+// dataBlocks returns the stored data blocks of f in order of offset, and the
+// total size of the file in bytes.
+//
+// The file package does not expose the layout of file data directly, so we
+// recover it from the wire encoding of the file.
+func dataBlocks(f *file.File) ([]dataBlock, int64) {
+	idx := file.Encode(f).GetNode().GetIndex()
+	if idx == nil {
+		return nil, 0
+	}
+	size := int64(idx.TotalBytes)
+	if len(idx.Single) != 0 {
+		return []dataBlock{{base: 0, bytes: size, key: idx.Single}}, size
+	}
+	var out []dataBlock
+	for _, ext := range idx.Extents {
+		pos := int64(ext.Base)
+		for _, blk := range ext.Blocks {
+			out = append(out, dataBlock{base: pos, bytes: int64(blk.Bytes), key: blk.Key})
+			pos += int64(blk.Bytes)
+		}
+	}
+	return out, size
+}
+
+// appendBlockXAttr appends the value of the block attribute attr of f to buf,
+// and returns the resulting slice.
+//
+// The ffs.blocks attributes list the stored blocks of f in order of offset,
+// one per line, as the offset and size of the block in bytes and its storage
+// key, separated by spaces. The key is encoded in hex, or in base64 for the
+// ".b64" suffix; unlike the other "ffs.*" attributes, the raw binary key is
+// not available, since it could contain the separators.
+//
+// The kernel limits the value of an attribute to 64KiB, so for a file with
+// more than about 750 blocks, getxattr fails with E2BIG. Use ffs.blockCount
+// to check the number of blocks first.
+//
+// The ffs.split attribute reports the block splitter settings used by the
+// driver for new data, which are the defaults of the file package. The
+// settings are not recorded in storage, so files written by other tools may
+// have been split differently.
+func appendBlockXAttr(buf []byte, f *file.File, attr string) []byte {
+	switch attr {
+	case ffsBlockCount:
+		return strconv.AppendInt(buf, int64(f.Data().Len()), 10)
+	case ffsSplit:
+		return fmt.Appendf(buf, "defaults min=%d size=%d max=%d",
+			block.DefaultMin, block.DefaultSize, block.DefaultMax)
+	}
+	encode := hex.EncodeToString
+	if attr == ffsBlocksB64 {
+		encode = base64.StdEncoding.EncodeToString
+	}
+	blks, _ := dataBlocks(f)
+	for _, b := range blks {
+		buf = fmt.Appendf(buf, "%d %d %s\n", b.base, b.bytes, encode(b.key))
+	}
+	return buf
+}
+
+// findBlock returns the index of the block in blks containing offset, or -1 if
+// offset is not within a stored block.
+func findBlock(blks []dataBlock, offset int64) int {
+	for i, b := range blks {
+		if b.base > offset {
+			break
+		} else if offset < b.end() {
+			return i
+		}
+	}
+	return -1
+}
+
+// isBoundary reports whether offset is not strictly inside any block of blks,
+// so that blocks can be replaced or inserted at that offset without splitting
+// stored data.
+func isBoundary(blks []dataBlock, offset int64) bool {
+	i := findBlock(blks, offset)
+	return i < 0 || blks[i].base == offset
+}
+
+// encodeIndex packs blks into a wire format index for a file of the given
+// size. The blocks must be in order of offset and must not overlap.
+func encodeIndex(blks []dataBlock, size int64) *wiretype.Index {
+	if len(blks) == 0 && size == 0 {
+		return nil
+	} else if len(blks) == 1 && blks[0].base == 0 && blks[0].bytes == size {
+		return &wiretype.Index{TotalBytes: uint64(size), Single: blks[0].key}
+	}
+	idx := &wiretype.Index{TotalBytes: uint64(size)}
+	for _, b := range blks {
+		wb := &wiretype.Block{Bytes: uint64(b.bytes), Key: b.key}
+		if n := len(idx.Extents); n != 0 && int64(idx.Extents[n-1].Base+idx.Extents[n-1].Bytes) == b.base {
+			last := idx.Extents[n-1]
+			last.Bytes += wb.Bytes
+			last.Blocks = append(last.Blocks, wb)
+		} else {
+			idx.Extents = append(idx.Extents, &wiretype.Extent{
+				Base:   uint64(b.base),
+				Bytes:  uint64(b.bytes),
+				Blocks: []*wiretype.Block{wb},
+			})
+		}
+	}
+	idx.Normalize()
+	return idx
+}
+
+// errNotShareable is reported by shareBlocks when the target cannot share the
+// blocks of the source.
+var errNotShareable = errors.New("blocks cannot be shared")
+
+// shareBlocks replaces the range of f starting at offset dstOff with the
+// blocks of src spanning the range from lo to hi, sharing the storage of src
+// rather than copying the data. Both ends of the source and target ranges must
+// fall on block boundaries, otherwise shareBlocks reports errNotShareable and
+// f is not modified.
+//
+// Since the file package does not permit the data of an existing file to be
+// replaced by reference, the updated file is written to storage and reloaded,
+// and f is updated to serve the new file. Open handles of f refer to the node,
+// so they see the new file. The caller must hold the file lock of f, so that
+// no change to the old file is lost.
+func (f *FS) shareBlocks(ctx context.Context, src *file.File, lo, hi, dstOff int64) error {
+	if !f.st.opts.Store.IsValid() {
+		return errNotShareable
+	}
+	sblks, _ := dataBlocks(src)
+	if !isBoundary(sblks, lo) || !isBoundary(sblks, hi) {
+		return errNotShareable
+	}
+	old := f.file()
+	if f.st.linkCount(f.id) > 1 {
+		return errNotShareable // we cannot find the other names to update them
+	}
+	dblks, size := dataBlocks(old)
+	dlo, dhi := dstOff, dstOff+(hi-lo)
+	if !isBoundary(dblks, dlo) || !isBoundary(dblks, dhi) {
+		return errNotShareable
+	}
+
+	// Keep the blocks of dst outside the target range, and splice in the
+	// blocks of src inside the source range, shifted to the target.
+	var nblks []dataBlock
+	for _, b := range dblks {
+		if b.end() <= dlo {
+			nblks = append(nblks, b)
+		}
+	}
+	for _, b := range sblks {
+		if b.base >= lo && b.end() <= hi {
+			b.base += dlo - lo
+			nblks = append(nblks, b)
+		}
+	}
+	for _, b := range dblks {
+		if b.base >= dhi {
+			nblks = append(nblks, b)
+		}
+	}
+
+	obj := file.Encode(old)
+	obj.GetNode().Index = encodeIndex(nblks, max(size, dhi))
+	key, err := wiretype.Save(ctx, f.st.opts.Store.Files(), obj)
+	if err != nil {
+		return err
+	}
+	nf, err := old.Load(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	// Stat is not stored unless it is persistent, so copy it explicitly.
+	ost := old.Stat()
+	nf.Stat().
+		WithMode(ost.Mode).WithModTime(time.Now()).
+		WithOwnerID(ost.OwnerID).WithOwnerName(ost.OwnerName).
+		WithGroupID(ost.GroupID).WithGroupName(ost.GroupName).
+		Update().Persist(ost.Persistent())
+	if !f.replaceFile(ctx, old, nf) {
+		return errNotShareable
+	}
+	return nil
+}
+
+// copyBufferSize is the size of the buffer used to copy file data.
+const copyBufferSize = 1 << 20
+
+// copyBytes copies n bytes of data from src at offset srcOff to dst at offset
+// dstOff, by reading and writing the data.
+func copyBytes(ctx context.Context, dst, src *file.File, dstOff, srcOff, n int64) error {
+	buf := make([]byte, min(n, copyBufferSize))
+	for n > 0 {
+		nr, err := src.ReadAt(ctx, buf[:min(n, int64(len(buf)))], srcOff)
+		if nr > 0 {
+			if _, err := dst.WriteAt(ctx, buf[:nr], dstOff); err != nil {
+				return err
+			}
+			srcOff += int64(nr)
+			dstOff += int64(nr)
+			n -= int64(nr)
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// zeroRange writes zeroes to the file served by f over the stored portions of
+// the range from lo to hi. Blocks that are entirely zero are not stored, so
+// this releases storage for the range. The caller must hold the file lock of
+// f.
+func (f *FS) zeroRange(ctx context.Context, lo, hi int64) error {
+	var zero []byte
+	for _, s := range f.layout().spans {
+		a, b := max(lo, s.base), min(hi, s.end)
+		if a >= b {
+			continue // outside the range, or no stored data in it
+		}
+		if zero == nil {
+			zero = make([]byte, min(hi-lo, copyBufferSize))
+		}
+		for a < b {
+			nw, err := f.file().WriteAt(ctx, zero[:min(b-a, int64(len(zero)))], a)
+			if err != nil {
+				return err
+			}
+			a += int64(nw)
+		}
+	}
+	return nil
+}
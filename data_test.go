@@ -0,0 +1,386 @@
+// Copyright 2019 Michael J. Fromberger. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ffuse_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+
+	"github.com/creachadair/ffs/blob"
+	"github.com/creachadair/ffs/blob/memstore"
+	"github.com/creachadair/ffs/filetree"
+	"github.com/creachadair/ffuse"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// truncate sets the size of node to size.
+func truncate(t *testing.T, ctx context.Context, node *ffuse.FS, size uint64) {
+	t.Helper()
+	in := &fuse.SetAttrIn{SetAttrInCommon: fuse.SetAttrInCommon{Valid: fuse.FATTR_SIZE, Size: size}}
+	if e := node.Setattr(ctx, nil, in, new(fuse.AttrOut)); e != 0 {
+		t.Fatalf("Truncate to %d: %v", size, e)
+	}
+}
+
+// getAttr returns the attributes of node.
+func getAttr(t *testing.T, ctx context.Context, node *ffuse.FS) *fuse.AttrOut {
+	t.Helper()
+	var out fuse.AttrOut
+	if e := node.Getattr(ctx, nil, &out); e != 0 {
+		t.Fatalf("Getattr: %v", e)
+	}
+	return &out
+}
+
+func TestLseekTruncated(t *testing.T) {
+	root, ctx := newTestFS(t)
+	const dataLen = 100000
+	const fileLen = 1 << 20
+	node := createFile(t, ctx, root, "sparse", strings.Repeat("abcdefghij", dataLen/10))
+
+	// Extending the file with truncate adds a hole at the end, which has no
+	// stored blocks.
+	truncate(t, ctx, node, fileLen)
+	attr := getAttr(t, ctx, node)
+	if attr.Size != fileLen {
+		t.Errorf("Size: got %d, want %d", attr.Size, fileLen)
+	}
+	if want := uint64((dataLen + 511) / 512); attr.Blocks != want {
+		t.Errorf("Blocks: got %d, want %d", attr.Blocks, want)
+	}
+
+	fh, _, e := node.Open(ctx, syscall.O_RDONLY)
+	if e != 0 {
+		t.Fatalf("Open: %v", e)
+	}
+	seeker := fh.(fs.FileLseeker)
+	for _, tc := range []struct {
+		off    uint64
+		whence uint32
+		want   uint64
+		errno  syscall.Errno
+	}{
+		{0, 3, 0, 0},                       // SEEK_DATA in data
+		{5000, 3, 5000, 0},                 // SEEK_DATA in data
+		{dataLen, 3, 0, syscall.ENXIO},     // SEEK_DATA in the trailing hole
+		{fileLen, 3, 0, syscall.ENXIO},     // SEEK_DATA at EOF
+		{0, 4, dataLen, 0},                 // SEEK_HOLE in data
+		{dataLen + 10, 4, dataLen + 10, 0}, // SEEK_HOLE in a hole
+		{fileLen - 1, 4, fileLen - 1, 0},   // SEEK_HOLE at the last byte
+		{fileLen, 4, 0, syscall.ENXIO},     // SEEK_HOLE at EOF
+		{fileLen + 1, 4, 0, syscall.ENXIO}, // SEEK_HOLE past EOF
+	} {
+		got, e := seeker.Lseek(ctx, tc.off, tc.whence)
+		if e != tc.errno {
+			t.Errorf("Lseek(%d, %d): got error %v, want %v", tc.off, tc.whence, e, tc.errno)
+		} else if e == 0 && got != tc.want {
+			t.Errorf("Lseek(%d, %d): got %d, want %d", tc.off, tc.whence, got, tc.want)
+		}
+	}
+
+	// Writing into the hole is reflected by later seeks.
+	wh, _, e := node.Open(ctx, syscall.O_WRONLY)
+	if e != 0 {
+		t.Fatalf("Open: %v", e)
+	}
+	if _, e := wh.(fs.FileWriter).Write(ctx, []byte(strings.Repeat("z", 5000)), 500000); e != 0 {
+		t.Fatalf("Write: %v", e)
+	}
+	if got, e := seeker.Lseek(ctx, dataLen, 3); e != 0 || got <= dataLen || got > 500000 {
+		t.Errorf("Lseek(%d, SEEK_DATA) after write: got %d, %v; want data by offset 500000", dataLen, got, e)
+	}
+	if got := getAttr(t, ctx, node).Blocks; got <= attr.Blocks {
+		t.Errorf("Blocks after write: got %d, want more than %d", got, attr.Blocks)
+	}
+}
+
+// randomData returns n bytes of pseudo-random data, which the splitter
+// divides into several blocks.
+func randomData(n int) string {
+	r := rand.New(rand.NewPCG(1, uint64(n)))
+	buf := make([]byte, n)
+	for i := range buf {
+		buf[i] = byte(r.Uint32())
+	}
+	return string(buf)
+}
+
+func TestBlockXAttrs(t *testing.T) {
+	root, ctx := newTestFS(t)
+	const dataLen = 300000
+	node := createFile(t, ctx, root, "f", randomData(dataLen))
+
+	plain := getXAttr(t, ctx, node, "ffs.blocks")
+	if hex := getXAttr(t, ctx, node, "ffs.blocks.hex"); plain != hex {
+		t.Errorf("ffs.blocks differs from ffs.blocks.hex:\n%s\n%s", plain, hex)
+	}
+	b64 := strings.Split(strings.TrimSpace(getXAttr(t, ctx, node, "ffs.blocks.b64")), "\n")
+	lines := strings.Split(strings.TrimSpace(plain), "\n")
+	if n, _ := strconv.Atoi(getXAttr(t, ctx, node, "ffs.blockCount")); n != len(lines) || n < 2 {
+		t.Errorf("ffs.blockCount: got %d, want %d (at least 2)", n, len(lines))
+	}
+
+	var pos int64
+	for i, line := range lines {
+		var base, size int64
+		var hkey, bkey string
+		if _, err := fmt.Sscanf(line, "%d %d %s", &base, &size, &hkey); err != nil {
+			t.Fatalf("Line %d: %q: %v", i+1, line, err)
+		}
+		if _, err := fmt.Sscanf(b64[i], "%d %d %s", &base, &size, &bkey); err != nil {
+			t.Fatalf("Line %d: %q: %v", i+1, b64[i], err)
+		}
+		hk, herr := hex.DecodeString(hkey)
+		bk, berr := base64.StdEncoding.DecodeString(bkey)
+		if herr != nil || berr != nil || !bytes.Equal(hk, bk) {
+			t.Errorf("Line %d: keys %q and %q do not match", i+1, hkey, bkey)
+		}
+		if base != pos {
+			t.Errorf("Line %d: base %d, want %d", i+1, base, pos)
+		}
+		pos = base + size
+	}
+	if pos != dataLen {
+		t.Errorf("Blocks end at %d, want %d", pos, dataLen)
+	}
+	if got := getXAttr(t, ctx, node, "ffs.split"); !strings.HasPrefix(got, "defaults ") {
+		t.Errorf("ffs.split: got %q, want defaults", got)
+	}
+}
+
+// openFile opens node with the given flags, and returns its handle.
+func openFile(t *testing.T, ctx context.Context, node *ffuse.FS, flags uint32) fs.FileHandle {
+	t.Helper()
+	fh, _, e := node.Open(ctx, flags)
+	if e != 0 {
+		t.Fatalf("Open: %v", e)
+	}
+	t.Cleanup(func() { fh.(fs.FileReleaser).Release(ctx) })
+	return fh
+}
+
+// readFile returns the contents of node.
+func readFile(t *testing.T, ctx context.Context, node *ffuse.FS) string {
+	t.Helper()
+	buf := make([]byte, getAttr(t, ctx, node).Size)
+	rr, e := openFile(t, ctx, node, syscall.O_RDONLY).(fs.FileReader).Read(ctx, buf, 0)
+	if e != 0 {
+		t.Fatalf("Read: %v", e)
+	}
+	data, _ := rr.Bytes(buf)
+	return string(data)
+}
+
+// copyRange copies n bytes from src at offset srcOff to dst at offset dstOff
+// with copy_file_range(2), as cp(1) does: in requests of at most chunk bytes,
+// each continuing where the previous one stopped.
+func copyRange(t *testing.T, ctx context.Context, src, dst *ffuse.FS, srcOff, dstOff, n, chunk uint64) {
+	t.Helper()
+	in := openFile(t, ctx, src, syscall.O_RDONLY)
+	out := openFile(t, ctx, dst, syscall.O_WRONLY)
+	for n > 0 {
+		nc, e := src.CopyFileRange(ctx, in, srcOff, dst.EmbeddedInode(), out, dstOff, min(n, chunk), 0)
+		if e != 0 {
+			t.Fatalf("CopyFileRange at %d: %v", srcOff, e)
+		} else if nc == 0 {
+			t.Fatalf("CopyFileRange at %d: copied nothing", srcOff)
+		}
+		srcOff, dstOff, n = srcOff+uint64(nc), dstOff+uint64(nc), n-uint64(nc)
+	}
+}
+
+// countingKV is a blob.KV that counts the bytes read from it.
+type countingKV struct {
+	blob.KV
+	n *atomic.Int64
+}
+
+func (c countingKV) Get(ctx context.Context, key string) ([]byte, error) {
+	data, err := c.KV.Get(ctx, key)
+	c.n.Add(int64(len(data)))
+	return data, err
+}
+
+func TestCopyFileRangeShared(t *testing.T) {
+	var nread atomic.Int64
+	st, err := filetree.NewStore(t.Context(), memstore.New(func() blob.KV {
+		return countingKV{KV: memstore.NewKV(), n: &nread}
+	}))
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+	opts := &ffuse.Options{Store: st}
+	root, ctx := newTestFSOptions(t, opts)
+	const dataLen = 1 << 20
+	data := randomData(dataLen)
+	src := createFile(t, ctx, root, "src", data)
+	want := getXAttr(t, ctx, src, "ffs.blocks.hex")
+
+	// A copy in chunks that do not fall on block boundaries still shares all
+	// the blocks of the source, because each short copy ends on a boundary.
+	// Each chunk is larger than the largest block, so it spans a whole block.
+	// Sharing the blocks does not read the data of the source.
+	for _, chunk := range []uint64{dataLen, 1<<17 + 1} {
+		name := fmt.Sprintf("dst%d", chunk)
+		dst := createFile(t, ctx, root, name, "")
+		root.AddChild(name, dst.EmbeddedInode(), true) // as the FUSE bridge does
+		nread.Store(0)
+		copyRange(t, ctx, src, dst, 0, 0, dataLen, chunk)
+		if n := nread.Load(); n >= dataLen/8 {
+			t.Errorf("Copy in chunks of %d: read %d bytes from storage, want less than %d", chunk, n, dataLen/8)
+		}
+		if got := getXAttr(t, ctx, dst, "ffs.blocks.hex"); got != want {
+			t.Errorf("Copy in chunks of %d: blocks differ from the source:\n%s\nwant:\n%s", chunk, got, want)
+		}
+		if got := readFile(t, ctx, dst); got != data {
+			t.Errorf("Copy in chunks of %d: data differs from the source", chunk)
+		}
+	}
+
+	// The directory links the updated file, so the copy survives a remount.
+	nr := remount(t, ctx, root, opts.Store, nil)
+	if got := readFile(t, ctx, lookup(t, ctx, nr, "dst1048576")); got != data {
+		t.Error("After remount: copied data differs from the source")
+	}
+}
+
+func TestCopyFileRangeFallback(t *testing.T) {
+	root, ctx := newTestFS(t)
+	data := randomData(200000)
+	src := createFile(t, ctx, root, "src", data)
+	dst := createFile(t, ctx, root, "dst", "0123456789")
+
+	// A target offset inside a block of the target cannot share blocks, so
+	// the data are copied.
+	copyRange(t, ctx, src, dst, 0, 5, uint64(len(data)), math.MaxUint32)
+	if got, want := readFile(t, ctx, dst), "01234"+data; got != want {
+		t.Errorf("Copy at offset 5: got %d bytes, want %d (equal: %v)", len(got), len(want), got == want)
+	}
+
+	// The source must be open for reading, and the target for writing.
+	for _, tc := range []struct {
+		in, out uint32
+	}{{syscall.O_WRONLY, syscall.O_WRONLY}, {syscall.O_RDONLY, syscall.O_RDONLY}} {
+		in, out := openFile(t, ctx, src, tc.in), openFile(t, ctx, dst, tc.out)
+		if _, e := src.CopyFileRange(ctx, in, 0, dst.EmbeddedInode(), out, 0, 10, 0); e != syscall.EBADF {
+			t.Errorf("CopyFileRange with flags %#x, %#x: got %v, want %v", tc.in, tc.out, e, syscall.EBADF)
+		}
+	}
+}
+
+func TestAllocate(t *testing.T) {
+	root, ctx := newTestFS(t)
+	const (
+		keepSize  = 0x01 // FALLOC_FL_KEEP_SIZE
+		punchHole = 0x02 // FALLOC_FL_PUNCH_HOLE
+		zeroRange = 0x10 // FALLOC_FL_ZERO_RANGE
+	)
+	data := randomData(300000)
+	node := createFile(t, ctx, root, "f", data)
+	fa := openFile(t, ctx, node, syscall.O_RDWR).(fs.FileAllocater)
+	blocks := getAttr(t, ctx, node).Blocks
+
+	// Punching a hole keeps the size, and releases the storage for the range.
+	if e := fa.Allocate(ctx, 100000, 100000, punchHole|keepSize); e != 0 {
+		t.Fatalf("Allocate(PUNCH_HOLE|KEEP_SIZE): %v", e)
+	}
+	want := data[:100000] + strings.Repeat("\x00", 100000) + data[200000:]
+	if got := readFile(t, ctx, node); got != want {
+		t.Errorf("After punching a hole: contents differ (got %d bytes)", len(got))
+	}
+	attr := getAttr(t, ctx, node)
+	if attr.Size != uint64(len(data)) {
+		t.Errorf("Size after punching a hole: got %d, want %d", attr.Size, len(data))
+	}
+	if attr.Blocks >= blocks {
+		t.Errorf("Blocks after punching a hole: got %d, want fewer than %d", attr.Blocks, blocks)
+	}
+
+	// Punching a hole requires KEEP_SIZE.
+	if e := fa.Allocate(ctx, 0, 10, punchHole); e != syscall.EOPNOTSUPP {
+		t.Errorf("Allocate(PUNCH_HOLE): got %v, want %v", e, syscall.EOPNOTSUPP)
+	}
+
+	// With KEEP_SIZE, a range past the end does not change the size.
+	for _, mode := range []uint32{keepSize, zeroRange | keepSize} {
+		if e := fa.Allocate(ctx, uint64(len(data)), 5000, mode); e != 0 {
+			t.Fatalf("Allocate(%#x): %v", mode, e)
+		}
+		if got := getAttr(t, ctx, node).Size; got != uint64(len(data)) {
+			t.Errorf("Size after Allocate(%#x): got %d, want %d", mode, got, len(data))
+		}
+	}
+
+	// Without KEEP_SIZE, the size is extended to the end of the range, which
+	// reads as zeroes.
+	for i, mode := range []uint32{0, zeroRange} {
+		size := uint64(len(data) + (i+1)*5000)
+		if e := fa.Allocate(ctx, size-5000, 5000, mode); e != 0 {
+			t.Fatalf("Allocate(%#x): %v", mode, e)
+		}
+		if got := getAttr(t, ctx, node).Size; got != size {
+			t.Errorf("Size after Allocate(%#x): got %d, want %d", mode, got, size)
+		}
+	}
+	want += strings.Repeat("\x00", 10000)
+	if got := readFile(t, ctx, node); got != want {
+		t.Errorf("After extending: contents differ (got %d bytes)", len(got))
+	}
+
+	// A large hole has no stored data, so punching it does not write zeroes
+	// over the whole range.
+	sparse := createFile(t, ctx, root, "sparse", "x")
+	truncate(t, ctx, sparse, 1<<40)
+	sa := openFile(t, ctx, sparse, syscall.O_RDWR).(fs.FileAllocater)
+	if e := sa.Allocate(ctx, 0, 1<<40, punchHole|keepSize); e != 0 {
+		t.Fatalf("Allocate(PUNCH_HOLE|KEEP_SIZE) on a sparse file: %v", e)
+	}
+	if attr := getAttr(t, ctx, sparse); attr.Size != 1<<40 || attr.Blocks != 0 {
+		t.Errorf("Sparse file: got size %d, blocks %d; want %d, 0", attr.Size, attr.Blocks, uint64(1<<40))
+	}
+
+	// A range that ends past the largest file offset is refused.
+	for _, tc := range []struct{ off, size uint64 }{
+		{math.MaxInt64, 1},
+		{1, math.MaxInt64},
+		{math.MaxInt64 + 1, 0},
+		{math.MaxUint64 - 10, 100}, // off+size wraps around
+	} {
+		for _, mode := range []uint32{0, keepSize, zeroRange, punchHole | keepSize} {
+			if e := fa.Allocate(ctx, tc.off, tc.size, mode); e != syscall.EFBIG {
+				t.Errorf("Allocate(%d, %d, %#x): got %v, want %v", tc.off, tc.size, mode, e, syscall.EFBIG)
+			}
+		}
+	}
+	if got := getAttr(t, ctx, node).Size; got != uint64(len(want)) {
+		t.Errorf("Size after refused Allocate: got %d, want %d", got, len(want))
+	}
+
+	// A range that ends exactly at the largest offset is accepted.
+	if e := sa.Allocate(ctx, math.MaxInt64-10, 10, punchHole|keepSize); e != 0 {
+		t.Errorf("Allocate up to the largest offset: %v", e)
+	}
+}
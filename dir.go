@@ -0,0 +1,298 @@
+// Copyright 2019 Michael J. Fromberger. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ffuse
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"syscall"
+
+	"github.com/creachadair/ffs/file"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+const (
+	// dirPageSize is the number of entries a dirStream loads at once.
+	dirPageSize = 128
+
+	// dirLoadConcurrency is the maximum number of children a dirStream loads
+	// concurrently from storage.
+	dirLoadConcurrency = 16
+)
+
+// A dirStream lists the entries of a directory. It serves both as a
+// [fs.DirStream] and as a directory handle.
+//
+// The names and storage keys of the entries are captured when the stream is
+// opened, but the children are loaded only as the stream reaches them, a page
+// at a time, to find their types. The offset of each entry is its position in
+// the list plus one, so a stream can seek to any entry. Entries removed from
+// the directory after the stream was opened are skipped.
+//
+// Opening a child through the directory holds the lock of the directory while
+// the child is fetched, so a stream fetches stored children concurrently by
+// key instead. Such a copy is detached: it is used to list the entry, and is
+// linked into the directory only if the stream looks up the entry and the
+// directory has not meanwhile loaded the child itself.
+//
+// When a stream loads every page in order, it records the number of
+// subdirectories it found in the summary of the directory, unless the
+// directory changed meanwhile.
+type dirStream struct {
+	ctx   context.Context // for use by the DirStream methods
+	f     *FS
+	names []string
+	keys  []string // the storage keys of names, or "" if not stored
+	gen   uint64   // the generation of the directory entries for names
+	pos   int      // index in names of the next entry
+
+	page []dirEntry // loaded entries, starting at index base of names
+	base int
+
+	counted int // number of entries whose types were counted, or -1
+	subdirs int // number of counted entries that are directories
+}
+
+// A dirEntry is a loaded entry of a dirStream.
+type dirEntry struct {
+	ent      fuse.DirEntry
+	kid      *file.File // nil if the entry was removed or could not be loaded
+	detached bool       // kid is a copy fetched by key, not linked in the directory
+	err      error      // the error from loading the entry, if any
+}
+
+func (f *FS) newDirStream(ctx context.Context) *dirStream {
+	// Hold the directory lock so that the names reflect either all or none of
+	// the changes of an operation that edits several entries.
+	f.dirMu.Lock()
+	defer f.dirMu.Unlock()
+	d := &dirStream{ctx: ctx, f: f, gen: f.dirGen()}
+	for _, kid := range file.Encode(f.file()).GetNode().Children {
+		d.names = append(d.names, kid.Name)
+		d.keys = append(d.keys, string(kid.Key))
+	}
+	if len(d.names) == 0 {
+		d.f.noteSubdirs(d.gen, 0)
+	}
+	return d
+}
+
+// entry returns the loaded entry at index i of the stream, loading the page
+// containing it if necessary.
+func (d *dirStream) entry(i int) *dirEntry {
+	if i < d.base || i >= d.base+len(d.page) {
+		d.load(i - i%dirPageSize)
+	}
+	return &d.page[i-d.base]
+}
+
+// load loads the page of entries starting at index base.
+func (d *dirStream) load(base int) {
+	names := d.names[base:min(base+dirPageSize, len(d.names))]
+	page := make([]dirEntry, len(names))
+
+	sem := make(chan struct{}, dirLoadConcurrency)
+	var wg sync.WaitGroup
+	for i, name := range names {
+		// If the child has a node, its type is known without loading it.
+		if c := d.f.liveChild(name); c != nil {
+			page[i] = dirEntry{
+				ent: fuse.DirEntry{Name: name, Mode: c.StableAttr().Mode, Ino: c.StableAttr().Ino},
+				kid: c.file(),
+			}
+			continue
+		}
+		sem <- struct{}{}
+		wg.Go(func() {
+			defer func() { <-sem }()
+			kid, detached, err := d.loadChild(name, d.keys[base+i])
+			if errors.Is(err, file.ErrChildNotFound) {
+				return // removed since the stream was opened
+			} else if err != nil {
+				page[i].err = err
+				return
+			}
+			page[i] = dirEntry{
+				ent: fuse.DirEntry{
+					Name: name,
+					Mode: modeFileType(kid.Stat().Mode),
+					Ino:  d.f.st.inode(d.f.childID(name)),
+				},
+				kid:      kid,
+				detached: detached,
+			}
+		})
+	}
+	wg.Wait()
+	d.page, d.base = page, base
+	d.count()
+}
+
+// loadChild loads the child name of the directory, whose storage key was key
+// when the stream was opened. A stored child is fetched by its key, without
+// holding the lock of the directory, and the copy is reported as detached.
+func (d *dirStream) loadChild(name, key string) (_ *file.File, detached bool, _ error) {
+	if key == "" {
+		kid, err := d.f.openChild(d.ctx, name) // not stored, so already loaded
+		return kid, false, err
+	} else if !d.f.file().Child().Has(name) {
+		return nil, false, file.ErrChildNotFound
+	}
+	kid, err := d.f.file().Load(d.ctx, key)
+	return kid, true, err
+}
+
+// count counts the subdirectories in the current page, if it follows the
+// entries already counted. When every entry has been counted, it records the
+// total in the summary of the directory.
+func (d *dirStream) count() {
+	if d.counted != d.base {
+		return // a page was skipped or reloaded
+	}
+	for _, e := range d.page {
+		if e.kid == nil {
+			d.counted = -1 // an entry was removed or could not be loaded
+			return
+		} else if e.ent.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+			d.subdirs++
+		}
+	}
+	d.counted += len(d.page)
+	if d.counted == len(d.names) {
+		d.f.noteSubdirs(d.gen, d.subdirs)
+	}
+}
+
+// next returns the next entry of the stream, or nil if there are no more.
+func (d *dirStream) next() (*fuse.DirEntry, errno) {
+	for d.pos < len(d.names) {
+		e := d.entry(d.pos)
+		if e.err != nil {
+			d.page = nil // retry the load on the next call
+			return nil, errorToErrno(e.err)
+		}
+		d.pos++
+		if e.kid != nil {
+			ent := e.ent
+			ent.Off = uint64(d.pos)
+			return &ent, noError
+		}
+	}
+	return nil, noError
+}
+
+// HasNext implements part of the [fs.DirStream] interface.
+// An error loading the next entry is reported by Next.
+func (d *dirStream) HasNext() bool {
+	for d.pos < len(d.names) {
+		if e := d.entry(d.pos); e.err != nil || e.kid != nil {
+			return true
+		}
+		d.pos++ // skip removed entries
+	}
+	return false
+}
+
+// Next implements part of the [fs.DirStream] interface.
+func (d *dirStream) Next() (fuse.DirEntry, errno) {
+	e, errno := d.next()
+	if e == nil {
+		return fuse.DirEntry{}, errno
+	}
+	return *e, noError
+}
+
+// Close implements part of the [fs.DirStream] interface.
+func (d *dirStream) Close() {}
+
+// Verify that dirStream supports interfaces required by the FUSE integration.
+var (
+	_ fs.DirStream        = (*dirStream)(nil)
+	_ fs.FileLookuper     = (*dirStream)(nil)
+	_ fs.FileReaddirenter = (*dirStream)(nil)
+	_ fs.FileReleasedirer = (*dirStream)(nil)
+	_ fs.FileSeekdirer    = (*dirStream)(nil)
+)
+
+// Lookup implements the [fs.FileLookuper] interface. It is called for each
+// entry of a READDIRPLUS response, with the name of the entry most recently
+// returned by Readdirent. If the child was loaded through the directory to
+// list it, the node for it is created from the loaded file rather than by
+// loading it again.
+func (d *dirStream) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, errno) {
+	if e := d.f.checkAccess(ctx, permExec); e != noError {
+		return nil, e
+	}
+	if c := d.f.liveChild(name); c != nil {
+		c.fillAttr(ctx, &out.Attr)
+		return c.EmbeddedInode(), noError
+	}
+	if i := d.pos - 1; i >= d.base && i < d.base+len(d.page) && d.names[i] == name {
+		if e := d.page[i-d.base]; e.kid != nil {
+			kid := e.kid
+			if e.detached {
+				var err error
+				kid, err = d.attach(ctx, name, kid)
+				if errors.Is(err, file.ErrChildNotFound) {
+					return nil, syscall.ENOENT
+				} else if err != nil {
+					return nil, errorToErrno(err)
+				}
+			}
+			nfs, in := d.f.newChild(ctx, name, kid)
+			nfs.fillAttr(ctx, &out.Attr)
+			return in, noError
+		}
+	}
+	return d.f.Lookup(ctx, name, out) // not loaded, e.g., after a seek
+}
+
+// attach returns the child name of the directory, given kid, a detached copy
+// of it loaded by the stream. If the directory has not loaded the child, and
+// its entries have not changed since the stream was opened, kid is linked as
+// the child, so that it need not be fetched again. The driver does not unload
+// the children of a directory, so a child that is not loaded still has the
+// storage key by which the stream fetched kid.
+func (d *dirStream) attach(ctx context.Context, name string, kid *file.File) (*file.File, error) {
+	d.f.dirMu.Lock()
+	defer d.f.dirMu.Unlock()
+	if d.f.dirGen() != d.gen || d.f.isLoaded(name) || d.f.st.isLinked(d.f.childID(name)) {
+		return d.f.openChild(ctx, name) // the entry may have changed, be loaded, or have links
+	}
+	relinkChild(d.f.file(), name, kid)
+	d.f.noteLoaded(name)
+	return kid, nil
+}
+
+// Readdirent implements the [fs.FileReaddirenter] interface.
+func (d *dirStream) Readdirent(ctx context.Context) (*fuse.DirEntry, errno) {
+	d.ctx = ctx
+	return d.next()
+}
+
+// Releasedir implements the [fs.FileReleasedirer] interface.
+func (d *dirStream) Releasedir(ctx context.Context, releaseFlags uint32) { d.page = nil }
+
+// Seekdir implements the [fs.FileSeekdirer] interface.
+func (d *dirStream) Seekdir(ctx context.Context, off uint64) errno {
+	if off > uint64(len(d.names)) {
+		return syscall.EINVAL
+	}
+	d.ctx = ctx
+	d.pos = int(off)
+	return noError
+}
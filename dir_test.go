@@ -0,0 +1,260 @@
+// Copyright 2019 Michael J. Fromberger. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ffuse_test
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+
+	"github.com/creachadair/ffs/blob"
+	"github.com/creachadair/ffs/blob/memstore"
+	"github.com/creachadair/ffs/filetree"
+	"github.com/creachadair/ffuse"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestDirAttr(t *testing.T) {
+	root, ctx := newTestFS(t)
+	check := func(dir *ffuse.FS, nlink uint32, size uint64) {
+		t.Helper()
+		attr := getAttr(t, ctx, dir)
+		if attr.Nlink != nlink || attr.Size != size {
+			t.Errorf("Getattr: got nlink=%d size=%d, want %d, %d", attr.Nlink, attr.Size, nlink, size)
+		}
+	}
+	a := makeDir(t, ctx, root, "a")
+	check(a, 2, 0)
+	makeDir(t, ctx, a, "sub1")
+	makeDir(t, ctx, a, "sub2")
+	createFile(t, ctx, a, "file", "data")
+	check(a, 4, 3*32+4+4+4)
+
+	// Renaming a subdirectory moves its link to the new parent.
+	b := makeDir(t, ctx, root, "b")
+	if e := a.Rename(ctx, "sub1", b, "moved", 0); e != 0 {
+		t.Fatalf("Rename: %v", e)
+	}
+	check(a, 3, 2*32+4+4)
+	check(b, 3, 32+5)
+
+	if e := a.Unlink(ctx, "file"); e != 0 {
+		t.Fatalf("Unlink: %v", e)
+	}
+	check(a, 3, 32+4)
+	if e := a.Rmdir(ctx, "sub2"); e != 0 {
+		t.Fatalf("Rmdir: %v", e)
+	}
+	check(a, 2, 0)
+	check(root, 4, 2*32+2)
+}
+
+func TestDirAttrLoaded(t *testing.T) {
+	opts := new(ffuse.Options)
+	root, ctx := newTestFSOptions(t, opts)
+	d := makeDir(t, ctx, root, "d")
+	for _, name := range []string{"x", "y", "z"} {
+		makeDir(t, ctx, d, name)
+	}
+	createFile(t, ctx, d, "f", "data")
+
+	// A directory loaded from storage does not know its number of
+	// subdirectories until it has been listed.
+	nr := remount(t, ctx, root, opts.Store, nil)
+	nd := lookup(t, ctx, nr, "d")
+	if attr := getAttr(t, ctx, nd); attr.Nlink != 1 || attr.Size != 4*33 {
+		t.Errorf("Before listing: got nlink=%d size=%d, want 1, %d", attr.Nlink, attr.Size, 4*33)
+	}
+	if ents := readDir(t, ctx, nd); len(ents) != 4 {
+		t.Errorf("Readdir: got %d entries, want 4", len(ents))
+	}
+	if attr := getAttr(t, ctx, nd); attr.Nlink != 5 {
+		t.Errorf("After listing: got nlink=%d, want 5", attr.Nlink)
+	}
+	if _, e := nd.Mkdir(ctx, "w", 0755, new(fuse.EntryOut)); e != 0 {
+		t.Fatalf("Mkdir: %v", e)
+	}
+	if attr := getAttr(t, ctx, nd); attr.Nlink != 6 {
+		t.Errorf("After Mkdir: got nlink=%d, want 6", attr.Nlink)
+	}
+}
+
+func TestDirStreamSeek(t *testing.T) {
+	opts := new(ffuse.Options)
+	root, ctx := newTestFSOptions(t, opts)
+	d := makeDir(t, ctx, root, "d")
+	const numEntries = 300 // more than two pages
+	var names []string
+	for i := range numEntries {
+		name := fmt.Sprintf("e%03d", i)
+		if i%10 == 0 {
+			makeDir(t, ctx, d, name)
+		} else {
+			createFile(t, ctx, d, name, "")
+		}
+		names = append(names, name)
+	}
+
+	// Load the tree from storage, so that listing it loads the children.
+	nd := lookup(t, ctx, remount(t, ctx, root, opts.Store, nil), "d")
+	fh, _, e := nd.OpendirHandle(ctx, 0)
+	if e != 0 {
+		t.Fatalf("OpendirHandle: %v", e)
+	}
+	defer fh.(fs.FileReleasedirer).Releasedir(ctx, 0)
+	next := func() *fuse.DirEntry {
+		t.Helper()
+		ent, e := fh.(fs.FileReaddirenter).Readdirent(ctx)
+		if e != 0 {
+			t.Fatalf("Readdirent: %v", e)
+		}
+		return ent
+	}
+	seek := func(off uint64) {
+		t.Helper()
+		if e := fh.(fs.FileSeekdirer).Seekdir(ctx, off); e != 0 {
+			t.Fatalf("Seekdir %d: %v", off, e)
+		}
+	}
+
+	// Each entry has the offset of the entry after it.
+	for i, name := range names {
+		ent := next()
+		if ent == nil {
+			t.Fatalf("Entry %d: stream ended early", i)
+		}
+		isDir := ent.Mode&syscall.S_IFMT == syscall.S_IFDIR
+		if ent.Name != name || ent.Off != uint64(i+1) || isDir != (i%10 == 0) {
+			t.Errorf("Entry %d: got %q off=%d dir=%v, want %q off=%d dir=%v",
+				i, ent.Name, ent.Off, isDir, name, i+1, i%10 == 0)
+		}
+	}
+	if ent := next(); ent != nil {
+		t.Errorf("After the last entry: got %q", ent.Name)
+	}
+
+	// Seeking to the offset of an entry resumes after it, in any page, and
+	// skips entries removed since the stream was opened.
+	for _, off := range []uint64{250, 0, 130, 299} {
+		seek(off)
+		if ent := next(); ent == nil || ent.Name != names[off] || ent.Off != off+1 {
+			t.Errorf("After Seekdir %d: got %+v, want %q", off, ent, names[off])
+		}
+	}
+	if e := nd.Unlink(ctx, names[101]); e != 0 {
+		t.Fatalf("Unlink: %v", e)
+	}
+	seek(101)
+	if ent := next(); ent == nil || ent.Name != names[102] || ent.Off != 103 {
+		t.Errorf("After removal: got %+v, want %q", ent, names[102])
+	}
+	if e := fh.(fs.FileSeekdirer).Seekdir(ctx, numEntries+1); e != syscall.EINVAL {
+		t.Errorf("Seekdir past the end: got %v, want %v", e, syscall.EINVAL)
+	}
+}
+
+func TestDirStreamLookup(t *testing.T) {
+	var nread atomic.Int64
+	st, err := filetree.NewStore(t.Context(), memstore.New(func() blob.KV {
+		return countingKV{KV: memstore.NewKV(), n: &nread}
+	}))
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+	opts := &ffuse.Options{Store: st}
+	root, ctx := newTestFSOptions(t, opts)
+	d := makeDir(t, ctx, root, "d")
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		createFile(t, ctx, d, name, strings.Repeat(name, 3))
+	}
+
+	// Load the tree from storage, so that listing it loads the children.
+	nr := remount(t, ctx, root, st, nil)
+	nd := lookup(t, ctx, nr, "d")
+	fh, _, e := nd.OpendirHandle(ctx, 0)
+	if e != 0 {
+		t.Fatalf("OpendirHandle: %v", e)
+	}
+	defer fh.(fs.FileReleasedirer).Releasedir(ctx, 0)
+	fl := fh.(fs.FileLookuper)
+	next := func(want string) {
+		t.Helper()
+		ent, e := fh.(fs.FileReaddirenter).Readdirent(ctx)
+		if e != 0 {
+			t.Fatalf("Readdirent: %v", e)
+		} else if ent == nil || ent.Name != want {
+			t.Fatalf("Readdirent: got %+v, want %q", ent, want)
+		}
+	}
+	plusLookup := func(name string) *ffuse.FS {
+		t.Helper()
+		in, e := fl.Lookup(ctx, name, new(fuse.EntryOut))
+		if e != 0 {
+			t.Fatalf("Lookup %q: %v", name, e)
+		}
+		return in.Operations().(*ffuse.FS)
+	}
+
+	// The copy of the child loaded to list it is linked into the directory,
+	// so the lookup does not fetch it again, and changes to it are saved.
+	next("a")
+	nread.Store(0)
+	a := plusLookup("a")
+	if n := nread.Load(); n != 0 {
+		t.Errorf("Lookup a: read %d bytes from storage, want 0", n)
+	}
+	if _, e := openFile(t, ctx, a, syscall.O_WRONLY).(fs.FileWriter).Write(ctx, []byte("A"), 0); e != 0 {
+		t.Fatalf("Write a: %v", e)
+	}
+
+	// If the directory loaded the child meanwhile, the lookup uses that.
+	next("b")
+	lb := lookup(t, ctx, nd, "b")
+	if b := plusLookup("b"); b != lb {
+		t.Error("Lookup b: got a different node than the directory lookup")
+	}
+
+	// An entry removed meanwhile is not found.
+	next("c")
+	if e := nd.Unlink(ctx, "c"); e != 0 {
+		t.Fatalf("Unlink c: %v", e)
+	}
+	if _, e := fl.Lookup(ctx, "c", new(fuse.EntryOut)); e != syscall.ENOENT {
+		t.Errorf("Lookup c after Unlink: got %v, want %v", e, syscall.ENOENT)
+	}
+
+	// If the entries changed meanwhile, the child is opened through the
+	// directory.
+	next("d")
+	if e := nd.Rename(ctx, "e", nd, "f", 0); e != 0 {
+		t.Fatalf("Rename e: %v", e)
+	}
+	if got := readFile(t, ctx, plusLookup("d")); got != "ddd" {
+		t.Errorf("Lookup d after Rename: got %q, want %q", got, "ddd")
+	}
+
+	// An entry that is not the latest is looked up through the directory.
+	if got := readFile(t, ctx, plusLookup("a")); got != "Aaa" {
+		t.Errorf("Lookup a again: got %q, want %q", got, "Aaa")
+	}
+
+	// The change to the attached child survives a remount.
+	if got := readFile(t, ctx, lookup(t, ctx, lookup(t, ctx, remount(t, ctx, nr, st, nil), "d"), "a")); got != "Aaa" {
+		t.Errorf("After remount: a is %q, want %q", got, "Aaa")
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright 2019 Michael J. Fromberger. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ffuse
+
+import "github.com/creachadair/ffs/file"
+
+// A dirAttr summarizes the entries of a directory for its attributes, so
+// that reporting the attributes of a directory does not require a pass over
+// its entries. Once known, the summary is kept up to date as entries are
+// added and removed.
+//
+// The size is computed from the names of the entries when first needed. The
+// number of subdirectories requires the type of each child, so it is not
+// computed separately: it is known for a directory that was empty when its
+// node was created, and is recorded when a complete listing of the directory
+// loads every child.
+type dirAttr struct {
+	sized   bool   // whether size is known
+	size    int64  // estimated size of the entries in bytes
+	counted bool   // whether subdirs is known
+	subdirs int    // number of entries that are directories
+	gen     uint64 // incremented by each change to the entries
+
+	// The names of the children the driver has loaded or linked. The driver
+	// does not unload children, so a child whose name is not here has not
+	// been loaded since the directory was.
+	loaded map[string]bool
+}
+
+// entrySize returns the estimated size of a directory entry for name, +32
+// for the storage key. This is just an estimate; the point here is to have
+// some stable number that approximates how much storage the directory
+// occupies.
+func entrySize(name string) int64 { return int64(32 + len(name)) }
+
+// dirSummary returns the estimated size of the directory f, and its number of
+// subdirectories if that is known.
+func (f *FS) dirSummary() (size int64, subdirs int, ok bool) {
+	f.mu.Lock()
+	a := f.dattr
+	f.mu.Unlock()
+	if !a.sized {
+		f.dirMu.Lock()
+		defer f.dirMu.Unlock()
+		var size int64
+		for _, name := range f.file().Child().Names() {
+			size += entrySize(name)
+		}
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.dattr.size, f.dattr.sized = size, true
+		a = f.dattr
+	}
+	return a.size, a.subdirs, a.counted
+}
+
+// dirGen returns the generation of the entries of the directory f, which
+// changes whenever an entry is added or removed. The caller must hold the
+// directory lock of f.
+func (f *FS) dirGen() uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.dattr.gen
+}
+
+// noteLoaded records that the child name of the directory f is loaded.
+func (f *FS) noteLoaded(name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.noteLoadedLocked(name)
+}
+
+func (f *FS) noteLoadedLocked(name string) {
+	if f.dattr.loaded == nil {
+		f.dattr.loaded = make(map[string]bool)
+	}
+	f.dattr.loaded[name] = true
+}
+
+// isLoaded reports whether the child name of the directory f is loaded.
+func (f *FS) isLoaded(name string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.dattr.loaded[name]
+}
+
+// noteSubdirs records that the directory f had n subdirectories at the
+// generation gen, if its entries have not changed since.
+func (f *FS) noteSubdirs(gen uint64, n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.dattr.gen == gen {
+		f.dattr.subdirs, f.dattr.counted = n, true
+	}
+}
+
+// noteEntry updates the summary of the directory f for the addition (delta >
+// 0) or removal (delta < 0) of kid as its child name. The caller must hold
+// the directory lock of f, and call noteEntry after making the change.
+func (f *FS) noteEntry(name string, kid *file.File, delta int) {
+	has := f.file().Child().Has(name)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.dattr.gen++
+	if has {
+		f.noteLoadedLocked(name)
+	} else {
+		delete(f.dattr.loaded, name)
+	}
+	if f.dattr.sized {
+		f.dattr.size += int64(delta) * entrySize(name)
+	}
+	if f.dattr.counted && kid.Stat().Mode.IsDir() {
+		f.dattr.subdirs += delta
+	}
+}
+
+// addEntry links kid as the child name of the directory f, replacing old if
+// it is not nil, whose link count is updated. The caller must hold the
+// directory lock of f.
+func (f *FS) addEntry(name string, kid, old *file.File) {
+	if old != nil {
+		f.st.addLinks(f.childID(name), old, -1)
+	}
+	f.file().Child().Set(name, kid)
+	// Any record for name was for old, so assign kid its own ID.
+	f.assignChildID(name)
+	if old != nil {
+		f.noteEntry(name, old, -1)
+	}
+	f.noteEntry(name, kid, 1)
+}
+
+// removeEntry unlinks kid, the child name of the directory f, and updates its
+// link count. The caller must hold the directory lock of f.
+func (f *FS) removeEntry(name string, kid *file.File) {
+	f.st.addLinks(f.childID(name), kid, -1)
+	f.file().Child().Remove(name)
+	f.clearChildID(name)
+	f.noteEntry(name, kid, -1)
+}
@@ -11,6 +11,7 @@ import (
 	"os/exec"
 	"slices"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/creachadair/ffs/filetree"
@@ -36,7 +37,9 @@ import (
 // Run blocks until ctx ends or until the subprocess specified by its arguments
 // has exited, unmounts the filesystem, and reports its status. The caller is
 // responsible for flushing out the final state of the filesystem, which can be
-// recovered from the PathInfo field.
+// recovered from the PathInfo field. If BrowseRoots is set and the filesystem
+// is writable, Run flushes the trees of the roots itself once the filesystem
+// is unmounted.
 //
 // Run initalizes and mounts the filesystem if these have not already been
 // done, but if you need to perform tasks before and after mounting, you may
@@ -46,7 +49,7 @@ type Service struct {
 	Store filetree.Store
 
 	MountPath string // required
-	RootKey   string // required
+	RootKey   string // required unless BrowseRoots is true
 	Writable  bool
 	AutoFlush time.Duration
 	DebugLog  bool
@@ -54,16 +57,55 @@ type Service struct {
 	Exec      bool
 	ExecArgs  []string // command arguments, required if --exec is true
 
+	// StrictPermissions, if true, enforces Unix permission rules for callers.
+	// See [ffuse.Options].
+	StrictPermissions bool
+
+	// Atime controls when access times are updated, if the filesystem is
+	// writable. See [ffuse.Options].
+	Atime ffuse.AtimePolicy
+
+	// ListVirtualXAttrs, if true, lists the virtual "ffs.*" attributes among
+	// the extended attributes of each file. See [ffuse.Options].
+	ListVirtualXAttrs bool
+
+	// ControlDir, if non-empty, is the name of a virtual control directory in
+	// the root of the filesystem. See [ffuse.Control]. It is ignored if
+	// BrowseRoots is true.
+	ControlDir string
+
+	// BrowseRoots, if true, mounts a directory listing every root pointer in
+	// the store in place of the root given by RootKey. See [ffuse.Roots].
+	BrowseRoots bool
+
+	// WritableRoot, if set and BrowseRoots is true, reports whether the tree
+	// of the given root key may be modified. If nil, each tree is writable if
+	// Writable is true. It has no effect unless Writable is true.
+	WritableRoot func(rootKey string) bool
+
+	// CapacityPath, if set, is a path on the local filesystem where the store
+	// keeps its data, such as the directory of a file-based store. The mount
+	// reports the capacity of the filesystem containing it as its own. See
+	// [ffuse.LocalCapacity].
+	CapacityPath string
+
 	// Logf, if set, is used as the target for log output.  If nil, the service
 	// uses log.Printf. To suppress all log output, populate a no-op function.
 	Logf func(string, ...any)
 
 	// Path is set by Init to the path info for the filesystem root.
+	// It is nil if BrowseRoots is true.
 	Path *filetree.PathInfo
 
+	// Roots is set by Mount to the filesystem root if BrowseRoots is true.
+	Roots *ffuse.Roots
+
 	// Fuse library settings.
 	Options fs.Options
 	Server  *fuse.Server // populated by Mount or Run
+
+	flushMu sync.Mutex // serializes flushes of Path
+	didInit bool       // Init has succeeded
 }
 
 func (s *Service) logPrintf(msg string, args ...any) {
@@ -95,12 +137,27 @@ func (s *Service) Init(ctx context.Context) error {
 		return errors.New("missing store implementation")
 	case s.MountPath == "":
 		return errors.New("missing mount path")
-	case s.RootKey == "":
+	case s.RootKey == "" && !s.BrowseRoots:
 		return errors.New("missing root key")
+	case s.RootKey != "" && s.BrowseRoots:
+		return errors.New("root key and browsing roots are exclusive")
 	case s.Exec && len(s.ExecArgs) == 0:
 		return errors.New("missing exec command")
 	}
 
+	// If requested, hook up a logger for the FUSE internals (very noisy).
+	if s.DebugLog {
+		s.Options.MountOptions.Logger = log.New(os.Stderr, "FUSE: ", log.LstdFlags|log.Lmicroseconds)
+		s.Options.MountOptions.Debug = true
+	}
+	s.didInit = true
+
+	// When browsing roots, each root is loaded when it is first used.
+	if s.BrowseRoots {
+		s.vlogf("Browsing the roots of the store")
+		return nil
+	}
+
 	// Load the root of the filesystem.
 	pi, err := s.Store.OpenPath(ctx, s.RootKey)
 	if err != nil {
@@ -115,13 +172,6 @@ func (s *Service) Init(ctx context.Context) error {
 	} else {
 		s.vlogf("Loaded filesystem at %s (no root pointer)", filetree.FormatKey32(pi.FileKey))
 	}
-
-	// If requested, hook up a logger for the FUSE internals (very noisy).
-	if s.DebugLog {
-		s.Options.MountOptions.Logger = log.New(os.Stderr, "FUSE: ", log.LstdFlags|log.Lmicroseconds)
-		s.Options.MountOptions.Debug = true
-	}
-
 	return nil
 }
 
@@ -132,17 +182,71 @@ func (s *Service) Init(ctx context.Context) error {
 // therefore not necessary to call it explicitly unless you want to check the
 // success of mounting before attempting to serve requests.
 func (s *Service) Mount(ctx context.Context) error {
-	if s.Path == nil {
+	if !s.didInit {
 		if err := s.Init(ctx); err != nil {
 			return err
 		}
 	}
 	if !s.Writable {
 		s.Options.MountOptions.Options = append(s.Options.MountOptions.Options, "ro")
+
+		// The contents of a read-only filesystem do not change while it is
+		// mounted, so the kernel may cache names and attributes for a long
+		// time, unless the caller has chosen otherwise.
+		ttl := readOnlyCacheTimeout
+		if s.Options.EntryTimeout == nil {
+			s.Options.EntryTimeout = &ttl
+		}
+		if s.Options.AttrTimeout == nil {
+			s.Options.AttrTimeout = &ttl
+		}
+		// When browsing roots, new roots may appear while mounted.
+		if s.Options.NegativeTimeout == nil && !s.BrowseRoots {
+			s.Options.NegativeTimeout = &ttl
+		}
+	}
+	s.Options.MountOptions.EnableLocks = true // the filesystem handles locking
+
+	opts := ffuse.Options{
+		Store:             s.Store,
+		StrictPermissions: s.StrictPermissions,
+		ListVirtualXAttrs: s.ListVirtualXAttrs,
+		ReadOnly:          !s.Writable,
+	}
+	if s.ControlDir != "" && !s.BrowseRoots {
+		opts.Control = &ffuse.Control{Name: s.ControlDir, RootKey: s.Path.RootKey}
+		if s.Writable {
+			opts.Control.Flush = s.flush // also updates the root pointer
+		}
+	}
+
+	// Access times are not updated on a read-only filesystem.
+	if s.Writable {
+		opts.Atime = s.Atime
+	}
+
+	// If the backing store can report its capacity, plumb it through so that
+	// the filesystem can report usage.
+	if s.CapacityPath != "" {
+		opts.Capacity = ffuse.LocalCapacity(s.CapacityPath)
+	} else if cr, ok := s.Store.Base().(ffuse.CapacityReporter); ok {
+		opts.Capacity = cr
+	}
+
+	var rootNode fs.InodeEmbedder
+	if s.BrowseRoots {
+		ropts := &ffuse.RootsOptions{Tree: opts}
+		if s.Writable {
+			ropts.Writable = s.WritableRoot
+		}
+		s.Roots = ffuse.NewRoots(s.Store, ropts)
+		rootNode = s.Roots
+	} else {
+		rootNode = ffuse.New(s.Path.File, &opts)
 	}
 
 	var err error
-	s.Server, err = fs.Mount(s.MountPath, ffuse.NewFS(s.Path.File), &s.Options)
+	s.Server, err = fs.Mount(s.MountPath, rootNode, &s.Options)
 	if err != nil {
 		return err
 	} else if err := s.Server.WaitMount(); err != nil {
@@ -151,6 +255,10 @@ func (s *Service) Mount(ctx context.Context) error {
 	return nil
 }
 
+// readOnlyCacheTimeout is the default duration for which the kernel may cache
+// entries and attributes of a read-only filesystem.
+const readOnlyCacheTimeout = time.Hour
+
 // errServerExited is a sentinel error reported as the cause of cancellation
 // when the FUSE server exits, e.g., in response to an external unmount.
 var errServerExited = errors.New("server exited")
@@ -166,12 +274,28 @@ var errServerExited = errors.New("server exited")
 // its current working directory set to the root of the mount path. In this
 // case, when the subprocess exits, Run umounts the filesystem explicitly and
 // returns to the caller.
-func (s *Service) Run(ctx context.Context) error {
+//
+// If s.BrowseRoots and s.Writable are true, Run flushes the loaded trees of
+// s.Roots after the filesystem is unmounted, and reports any error in doing so
+// unless it has another error to report.
+func (s *Service) Run(ctx context.Context) (err error) {
 	if s.Server == nil {
 		if err := s.Mount(ctx); err != nil {
 			return fmt.Errorf("mount: %w", err)
 		}
 	}
+	if s.BrowseRoots && s.Writable {
+		defer func() {
+			// The context may have ended already, but the flush must not be
+			// abandoned on that account.
+			if ferr := s.Roots.Flush(context.WithoutCancel(ctx)); ferr != nil {
+				s.logPrintf("WARNING: Error flushing roots: %v", ferr)
+				if err == nil {
+					err = fmt.Errorf("flush roots: %w", ferr)
+				}
+			}
+		}()
+	}
 	sctx, cancel := context.WithCancelCause(ctx)
 	defer cancel(nil)
 	go func() {
@@ -266,8 +390,16 @@ func (s *Service) autoFlush(ctx context.Context, d time.Duration) {
 			s.vlogf("Stopping auto-flush routine")
 			return
 		case <-t.C:
+			if s.BrowseRoots {
+				if err := s.Roots.Flush(ctx); err != nil {
+					s.logPrintf("WARNING: Error flushing roots: %v", err)
+				}
+				continue
+			}
+			s.flushMu.Lock()
 			oldKey := s.Path.BaseKey
 			newKey, err := s.Path.Flush(ctx)
+			s.flushMu.Unlock()
 			if err != nil {
 				s.logPrintf("WARNING: Error flushing root: %v", err)
 			} else if oldKey != newKey {
@@ -276,3 +408,11 @@ func (s *Service) autoFlush(ctx context.Context, d time.Duration) {
 		}
 	}
 }
+
+// flush flushes the filesystem root, and the root pointer if there is one, and
+// returns the updated storage key of the root.
+func (s *Service) flush(ctx context.Context) (string, error) {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+	return s.Path.Flush(ctx)
+}
@@ -23,14 +23,20 @@ import (
 	"encoding/hex"
 	"errors"
 	"io"
+	"math"
 	"os"
 	"path"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/creachadair/ffs/blob"
 	"github.com/creachadair/ffs/file"
+	"github.com/creachadair/ffs/filetree"
 	"github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
 )
@@ -39,41 +45,320 @@ type errno = syscall.Errno
 
 const noError syscall.Errno = 0
 
-// NewFS constructs a new FS with the given root file.
-func NewFS(root *file.File) *FS { return &FS{file: root} }
+// NewFS constructs a new FS with the given root file and default options.
+// It is equivalent to New(root, nil).
+func NewFS(root *file.File) *FS { return New(root, nil) }
 
+// New constructs a new FS with the given root file and options.
+// If opts == nil, default options are used.
+func New(root *file.File, opts *Options) *FS { return newTree(root, opts, new(nodeTable)) }
+
+// newTree constructs a new FS with the given root file and options, whose
+// live nodes are recorded in nodes.
+func newTree(root *file.File, opts *Options, nodes *nodeTable) *FS {
+	st := &fsState{root: root, nodes: nodes}
+	if opts != nil {
+		st.opts = *opts
+	}
+	st.readOnly.Store(st.opts.ReadOnly)
+	st.flushed = root.Key()
+	st.usageKey = root.Key()
+	f := newFS(root, st)
+	f.id = 1
+	return f
+}
+
+// Options are optional settings for an [FS]. A nil *Options is ready for use
+// and provides default values as described.
+type Options struct {
+	// Store, if valid, is the store from which the tree was loaded. Some
+	// features, such as sharing blocks between files in copies, require
+	// direct access to storage, and are disabled if it is not set.
+	Store filetree.Store
+
+	// Capacity, if non-nil, is used to report the total and available space
+	// of the backing store via Statfs. If nil, Statfs reports the space used
+	// by the mounted tree, and reports the free space as unknown. For a store
+	// that keeps its data on a local filesystem, see [LocalCapacity].
+	Capacity CapacityReporter
+
+	// StrictPermissions, if true, enforces the usual Unix permission rules for
+	// the caller on access to files and on changes to the tree, including the
+	// caller's supplementary groups.
+	//
+	// By default, permissions are checked only by Access, which treats files
+	// owned by root as owned by the caller, and changes are not checked.
+	StrictPermissions bool
+
+	// Atime controls when the access times of files are updated.
+	// By default, access times are not updated.
+	Atime AtimePolicy
+
+	// ReadOnly, if true, refuses any change to the tree with EROFS.
+	ReadOnly bool
+
+	// Control, if non-nil, enables a virtual control directory in the root of
+	// the tree. See [Control].
+	Control *Control
+
+	// ListVirtualXAttrs, if true, includes the names of the virtual "ffs.*"
+	// attributes that are cheap to compute in the extended attributes listed
+	// for each file, such as ffs.dataHash, and the ffs.link.<name> attributes
+	// of a directory with at most maxListedLinks children. Attributes that
+	// flush or scan the tree, such as ffs.storageKey and ffs.tree.*, are not
+	// listed but may still be read. By default, only stored attributes are
+	// listed.
+	ListVirtualXAttrs bool
+}
+
+// A CapacityReporter is an optional interface that a storage backend may
+// implement to report its capacity.
+type CapacityReporter interface {
+	// Capacity reports the total and available capacity of the store in bytes.
+	Capacity(ctx context.Context) (total, avail int64, err error)
+}
+
+// LocalCapacity returns a [CapacityReporter] that reports the capacity of the
+// local filesystem containing path, for a store that keeps its data there,
+// such as a store of files in a directory.
+func LocalCapacity(path string) CapacityReporter { return localCapacity(path) }
+
+type localCapacity string
+
+func (c localCapacity) Capacity(ctx context.Context) (total, avail int64, err error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(string(c), &st); err != nil {
+		return 0, 0, err
+	}
+	bsize := int64(st.Bsize)
+	return int64(st.Blocks) * bsize, int64(st.Bavail) * bsize, nil
+}
+
+// An FS is a node in the tree of files served by the FUSE integration.
+//
+// The FUSE library may call the methods of a node concurrently, and the file
+// package synchronizes individual accesses to a file. Operations that need
+// several steps to be atomic hold these locks:
+//
+//   - The fileMu of a node is held while changing the contents or stat of its
+//     file, so that appends and other read-modify-write updates are atomic.
+//   - The dirMu of a node is held while changing the entries of a directory,
+//     so that checking for an entry and adding or removing it is atomic.
+//   - The nsMu of the tree is held by operations that lock more than one
+//     directory, or that change the link count of a file.
+//
+// Locks are acquired in the order nsMu, fileMu, dirMu. Since only holders of
+// nsMu lock more than one directory, directories may be locked in any order.
+// The remaining locks protect only their own fields, and are not held while
+// acquiring others.
 type FS struct {
 	// The fs.Inode is self-synchronizing, and is accessed via its
 	// implementation of the fs.InodeEmbedder interface. Its key requirement is
 	// that we must not copy the value.
 	fs.Inode
 
-	file *file.File
+	fp    atomic.Pointer[file.File] // the file served by this node
+	id    uint64                    // the persistent ID of the file (see inode.go)
+	st    *fsState                  // shared by all the nodes of the tree
+	locks lockTable                 // advisory locks held on this node
+
+	fileMu sync.Mutex // serializes changes to the contents and stat of the file
+	dirMu  sync.Mutex // serializes changes to the entries of a directory
+
+	mu       sync.Mutex
+	openHash string      // data hash of the file when last opened
+	dattr    dirAttr     // summary of the entries of a directory
+	dlayout  *dataLayout // cached layout of the file data, or nil
+}
+
+func newFS(nf *file.File, st *fsState) *FS {
+	f := &FS{st: st}
+	f.fp.Store(nf)
+	if nf.Stat().Mode.IsDir() && nf.Child().Len() == 0 {
+		f.dattr = dirAttr{sized: true, counted: true} // an empty directory needs no summary
+	}
+	return f
+}
+
+// newFS constructs a new FS node for nf sharing the state of f.
+func (f *FS) newFS(nf *file.File) *FS { return newFS(nf, f.st) }
+
+// file returns the file currently served by f.
+func (f *FS) file() *file.File { return f.fp.Load() }
+
+// replaceFile updates f to serve nf in place of old, its current file, and
+// reports whether it did so. If f has a parent directory, the parent is
+// updated to link nf instead; if the parent no longer links old under the
+// name of f, f is not changed. The caller must hold the file lock of f.
+func (f *FS) replaceFile(ctx context.Context, old, nf *file.File) bool {
+	if name, p := f.Parent(); p != nil {
+		pf, ok := p.Operations().(*FS)
+		if !ok {
+			return false
+		}
+		pf.dirMu.Lock()
+		defer pf.dirMu.Unlock()
+		if cur, err := pf.file().Open(ctx, name); err != nil || cur != old {
+			return false // moved or replaced since f was looked up
+		}
+		pf.noteLoaded(name)
+		relinkChild(pf.file(), name, nf)
+	}
+	f.fp.Store(nf)
+	return true
+}
+
+// liveChild returns the node for the named child of f, or nil if the child
+// has no node.
+func (f *FS) liveChild(name string) *FS {
+	if c := f.GetChild(name); c != nil {
+		cf, _ := c.Operations().(*FS)
+		return cf
+	}
+	return nil
+}
+
+// hasChild reports whether the directory f has a child with the given name,
+// including the control directory.
+func (f *FS) hasChild(name string) bool {
+	return f.file().Child().Has(name) || f.isControlName(name)
+}
+
+// lockDirs acquires the directory locks of the given nodes, skipping nil and
+// repeated nodes, and returns a function that releases them. The caller must
+// hold the namespace lock if more than one node is locked.
+func lockDirs(nodes ...*FS) (unlock func()) {
+	var held []*FS
+	for _, n := range nodes {
+		if n != nil && !slices.Contains(held, n) {
+			n.dirMu.Lock()
+			held = append(held, n)
+		}
+	}
+	return func() {
+		for _, n := range slices.Backward(held) {
+			n.dirMu.Unlock()
+		}
+	}
+}
+
+// relinkChild replaces the child of dir with the given name by kid.  This is
+// not a change to the directory as seen by the user, so it preserves the
+// modification time of dir.
+func relinkChild(dir *file.File, name string, kid *file.File) {
+	ds := dir.Stat()
+	dir.Child().Set(name, kid)
+	dir.Stat().WithModTime(ds.ModTime).Update()
+}
+
+// openChild opens the named child of f.
+//
+// Hard links are not recorded in storage, so when a file with multiple links
+// is loaded from storage, each name gets a separate copy. To preserve the
+// link, openChild relinks the child to the copy previously opened for another
+// name with the same ID, if there is one.
+func (f *FS) openChild(ctx context.Context, name string) (*file.File, error) {
+	kf, err := f.file().Open(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	f.noteLoaded(name)
+	if kf.Stat().Mode.IsDir() {
+		return kf, nil
+	}
+	id := f.childID(name)
+	f.st.mu.Lock()
+	defer f.st.mu.Unlock()
+	if f.st.linkCountLocked(id) < 2 {
+		return kf, nil
+	}
+	if lf, ok := f.st.links[id]; ok {
+		if lf != kf {
+			relinkChild(f.file(), name, lf)
+		}
+		return lf, nil
+	}
+	if f.st.links == nil {
+		f.st.links = make(map[uint64]*file.File)
+	}
+	f.st.links[id] = kf
+	return kf, nil
+}
+
+// fsState is state shared by all the nodes of a single FS tree.
+type fsState struct {
+	root     *file.File
+	opts     Options
+	readOnly atomic.Bool // refuse changes to the tree
+	salt     uint64      // mixed into inode numbers, if nonzero (see inode.go)
+
+	mu       sync.Mutex
+	flushed  string                // the storage key of the root as of its last flush by the control directory
+	changes  uint64                // the number of changes to the tree begun
+	staleKey string                // a storage key of the root that predates a change, if known
+	usageKey string                // the last known storage key of the root, for treeUsage
+	trees    map[string]*treeStats // cached directory statistics, by storage key
+	sizes    map[string]int64      // cached file data sizes, by storage key
+	nlinks   map[uint64]uint32     // recorded link counts, by ID; nil if not loaded
+	links    map[uint64]*file.File // open files with multiple links, by ID
+	nodes    *nodeTable            // live nodes, possibly shared with other trees
+	ctl      *fs.Inode             // the control directory, if enabled and used
+
+	// Serializes changes to the namespace that span multiple steps or files,
+	// such as renames and updates to link counts.
+	nsMu sync.Mutex
+}
+
+// treeUsage returns statistics about the contents of the tree as of its last
+// flush. It does not flush the tree, so changes since then are not counted.
+// If the root itself has changed since then, its storage key is not known, and
+// the last storage key seen by treeUsage is used instead. The statistics of
+// subtrees that have not changed since an earlier call are reused.
+func (s *fsState) treeUsage(ctx context.Context) (*treeStats, error) {
+	key := s.root.Key()
+	s.mu.Lock()
+	if key != "" {
+		s.usageKey = key
+	} else {
+		key = s.usageKey
+	}
+	s.mu.Unlock()
+	if key == "" {
+		return &treeStats{dirs: 1, blocks: -1}, nil // never flushed
+	}
+	return s.subtreeStats(ctx, s.root, key)
 }
 
 // Verify that the FS supports interfaces required by the FUSE integration.
 var (
 	_ fs.InodeEmbedder = (*FS)(nil)
 
-	_ fs.NodeAccesser      = (*FS)(nil)
-	_ fs.NodeCreater       = (*FS)(nil)
-	_ fs.NodeFsyncer       = (*FS)(nil)
-	_ fs.NodeGetattrer     = (*FS)(nil)
-	_ fs.NodeGetxattrer    = (*FS)(nil)
-	_ fs.NodeLinker        = (*FS)(nil)
-	_ fs.NodeListxattrer   = (*FS)(nil)
-	_ fs.NodeLookuper      = (*FS)(nil)
-	_ fs.NodeMkdirer       = (*FS)(nil)
-	_ fs.NodeOpener        = (*FS)(nil)
-	_ fs.NodeReaddirer     = (*FS)(nil)
-	_ fs.NodeReadlinker    = (*FS)(nil)
-	_ fs.NodeRemovexattrer = (*FS)(nil)
-	_ fs.NodeRenamer       = (*FS)(nil)
-	_ fs.NodeRmdirer       = (*FS)(nil)
-	_ fs.NodeSetattrer     = (*FS)(nil)
-	_ fs.NodeSetxattrer    = (*FS)(nil)
-	_ fs.NodeSymlinker     = (*FS)(nil)
-	_ fs.NodeUnlinker      = (*FS)(nil)
+	_ fs.NodeAccesser       = (*FS)(nil)
+	_ fs.NodeAllocater      = (*FS)(nil)
+	_ fs.NodeCopyFileRanger = (*FS)(nil)
+	_ fs.NodeCreater        = (*FS)(nil)
+	_ fs.NodeFsyncer        = (*FS)(nil)
+	_ fs.NodeGetattrer      = (*FS)(nil)
+	_ fs.NodeGetxattrer     = (*FS)(nil)
+	_ fs.NodeLinker         = (*FS)(nil)
+	_ fs.NodeListxattrer    = (*FS)(nil)
+	_ fs.NodeLookuper       = (*FS)(nil)
+	_ fs.NodeMkdirer        = (*FS)(nil)
+	_ fs.NodeMknoder        = (*FS)(nil)
+	_ fs.NodeOnForgetter    = (*FS)(nil)
+	_ fs.NodeOpendirHandler = (*FS)(nil)
+	_ fs.NodeOpener         = (*FS)(nil)
+	_ fs.NodeReaddirer      = (*FS)(nil)
+	_ fs.NodeReadlinker     = (*FS)(nil)
+	_ fs.NodeRemovexattrer  = (*FS)(nil)
+	_ fs.NodeRenamer        = (*FS)(nil)
+	_ fs.NodeRmdirer        = (*FS)(nil)
+	_ fs.NodeSetattrer      = (*FS)(nil)
+	_ fs.NodeSetxattrer     = (*FS)(nil)
+	_ fs.NodeStatfser       = (*FS)(nil)
+	_ fs.NodeStatxer        = (*FS)(nil)
+	_ fs.NodeSymlinker      = (*FS)(nil)
+	_ fs.NodeUnlinker       = (*FS)(nil)
 )
 
 // Access implements the [fs.NodeAccesser] interface.
@@ -82,7 +367,13 @@ func (f *FS) Access(ctx context.Context, mask uint32) errno {
 	if !ok {
 		return syscall.ENOSYS
 	}
-	s := f.file.Stat()
+	s := f.file().Stat()
+	if f.st.opts.StrictPermissions {
+		if !mayAccess(caller, s, mask) {
+			return syscall.EACCES
+		}
+		return noError
+	}
 	bits := uint32(s.Mode.Perm())
 
 	// Root is not special inside the FUSE mount, so treat the caller as
@@ -102,25 +393,143 @@ func (f *FS) Access(ctx context.Context, mask uint32) errno {
 	return noError
 }
 
+// Allocate implements the [fs.NodeAllocater] interface.
+func (f *FS) Allocate(ctx context.Context, fh fs.FileHandle, off, size uint64, mode uint32) errno {
+	if a, ok := fh.(fs.FileAllocater); ok {
+		return a.Allocate(ctx, off, size, mode)
+	}
+	return syscall.EBADF
+}
+
+// CopyFileRange implements the [fs.NodeCopyFileRanger] interface.
+//
+// Where the source range begins and ends on block boundaries, and the target
+// range can be replaced without splitting existing blocks, the target shares
+// the stored blocks of the source rather than copying their contents. Any
+// portion of the range that cannot be shared is copied, except that a copy
+// that shares blocks stops short at the last block boundary of the source.
+func (f *FS) CopyFileRange(ctx context.Context, fhIn fs.FileHandle, offIn uint64, out *fs.Inode, fhOut fs.FileHandle, offOut, n, flags uint64) (uint32, errno) {
+	if flags != 0 {
+		return 0, syscall.EINVAL
+	}
+	dst, ok := out.Operations().(*FS)
+	if !ok {
+		return 0, syscall.EXDEV
+	} else if h, ok := fhIn.(*fileHandle); !ok || !h.readable {
+		return 0, syscall.EBADF
+	} else if h, ok := fhOut.(*fileHandle); !ok || !h.writable {
+		return 0, syscall.EBADF
+	} else if e := dst.st.checkWritable(); e != noError {
+		return 0, e
+	}
+	dst.fileMu.Lock()
+	defer dst.fileMu.Unlock()
+	src := f.file()
+	if !src.Stat().Mode.IsRegular() || !dst.file().Stat().Mode.IsRegular() {
+		return 0, syscall.EINVAL
+	}
+
+	// Copying past the end of the source copies nothing. Otherwise, copy at
+	// most to the end of the source.
+	size := src.Data().Size()
+	if int64(offIn) >= size || n == 0 {
+		return 0, noError
+	}
+	n = min(n, uint64(size)-offIn, math.MaxUint32)
+	lo, hi, base := int64(offIn), int64(offIn+n), int64(offOut)
+
+	// Overlapping ranges within the same file are not allowed.
+	if src == dst.file() {
+		if lo < base+int64(n) && base < hi {
+			return 0, syscall.EINVAL
+		}
+		err := copyBytes(ctx, src, src, base, lo, int64(n))
+		return uint32(n), errorToErrno(err)
+	}
+
+	// Find the largest span of whole source blocks inside the range. The
+	// portion before that span is copied, and the rest is shared. A portion
+	// after the span is not copied, since writing it would re-split the end
+	// of the target, so that a later copy continuing from the end of the span
+	// could not share blocks either. The copy is reported as short, and the
+	// caller continues from a block boundary of the source.
+	a, b := lo, hi
+	sblks, _ := dataBlocks(src)
+	if i := findBlock(sblks, lo); i >= 0 && sblks[i].base < lo {
+		a = sblks[i].end()
+	}
+	if i := findBlock(sblks, hi); i >= 0 && sblks[i].base < hi {
+		b = sblks[i].base
+	}
+	if a >= b {
+		err := copyBytes(ctx, dst.file(), src, base, lo, int64(n))
+		return uint32(n), errorToErrno(err)
+	}
+	if err := copyBytes(ctx, dst.file(), src, base, lo, a-lo); err != nil {
+		return 0, errorToErrno(err)
+	}
+	if err := dst.shareBlocks(ctx, src, a, b, base+(a-lo)); errors.Is(err, errNotShareable) {
+		if err := copyBytes(ctx, dst.file(), src, base+(a-lo), a, b-a); err != nil {
+			return uint32(a - lo), errorToErrno(err)
+		}
+	} else if err != nil {
+		return uint32(a - lo), errorToErrno(err)
+	}
+	return uint32(b - lo), noError
+}
+
 // Create implements the [fs.NodeCreater] interface.
-func (f *FS) Create(ctx context.Context, name string, flags, mode uint32, out *fuse.EntryOut) (in *fs.Inode, fh fs.FileHandle, _ uint32, _ errno) {
+func (f *FS) Create(ctx context.Context, name string, flags, mode uint32, out *fuse.EntryOut) (*fs.Inode, fs.FileHandle, uint32, errno) {
 	caller, ok := fuse.FromContext(ctx)
 	if !ok {
 		return nil, nil, 0, syscall.ENOSYS
 	}
+	nfs, in, e := f.createChild(ctx, caller, name, flags, mode)
+	if e != noError {
+		return nil, nil, 0, e
+	}
 
-	nf, err := f.file.Open(ctx, name)
+	// Open the file after the directory is unlocked, since truncating it
+	// requires the file lock.
+	h, fuseFlags, e := nfs.open(ctx, flags)
+	if e != noError {
+		return nil, nil, 0, e
+	}
+	nfs.fillAttr(ctx, &out.Attr)
+	return in, h, fuseFlags, noError
+}
+
+// createChild returns the node for the named child of f, creating a new empty
+// file if it does not exist.
+func (f *FS) createChild(ctx context.Context, caller *fuse.Caller, name string, flags, mode uint32) (*FS, *fs.Inode, errno) {
+	f.dirMu.Lock()
+	defer f.dirMu.Unlock()
+
+	if f.isControlName(name) {
+		return nil, nil, syscall.EEXIST
+	}
+	nf, err := f.openChild(ctx, name)
 	if err == nil {
 		// The file already exists; if O_EXCL is set the request fails.
 		if flags&syscall.O_EXCL != 0 {
-			return nil, nil, 0, syscall.EEXIST
+			return nil, nil, syscall.EEXIST
+		}
+		if f.st.opts.StrictPermissions && !mayAccess(caller, nf.Stat(), openMask(flags)) {
+			return nil, nil, syscall.EACCES
+		}
+
+		// If we are re-opening an existing child of f, reuse the inode.
+		if c := f.GetChild(name); c != nil {
+			return c.Operations().(*FS), c, noError
 		}
 	} else if !errors.Is(err, file.ErrChildNotFound) {
-		return nil, nil, 0, errorToErrno(err)
+		return nil, nil, errorToErrno(err)
+	} else if e := f.checkAddEntry(ctx); e != noError {
+		return nil, nil, e
 	} else {
 		// The file does not exist; create a new empty file.
 		// Note that directories go through Mkdir instead.
-		nf = f.file.New(&file.NewOptions{
+		nf = f.file().New(&file.NewOptions{
 			Name: name,
 			Stat: &file.Stat{
 				Mode:    fromSysMode(mode, true),
@@ -129,60 +538,67 @@ func (f *FS) Create(ctx context.Context, name string, flags, mode uint32, out *f
 				GroupID: int(caller.Gid),
 			},
 		})
-		f.file.Child().Set(name, nf)
-	}
-
-	// IF the request wants the file truncated, do that now.
-	if flags&syscall.O_TRUNC != 0 {
-		if err := nf.Truncate(ctx, 0); err != nil {
-			return nil, nil, 0, errorToErrno(err)
-		}
-	}
-
-	nfs := &FS{file: nf}
-	nfs.fillAttr(&out.Attr)
-	fh = &fileHandle{fs: nfs, writable: !isReadOnly(flags), append: flags&syscall.O_APPEND != 0}
-
-	// If we are re-opening an existing child of f, reuse the inode.
-	if err == nil {
-		if c, ok := f.EmbeddedInode().Children()[name]; ok {
-			in = c
-			return
-		}
+		initFile(nf)
+		f.addEntry(name, nf, nil)
 	}
-	in = f.NewInode(ctx, nfs, fileStableAttr(nf))
-	return
+	nfs, in := f.newChild(ctx, name, nf)
+	return nfs, in, noError
 }
 
-func (f *FS) fillAttr(out *fuse.Attr) {
-	s := f.file.Stat()
-	var nb int64
+func (f *FS) fillAttr(ctx context.Context, out *fuse.Attr) {
+	s := f.file().Stat()
+	var nb, stored int64
 	var nlink uint32 = 1
 	if s.Mode.IsDir() {
-		nlink = uint32(2 + f.file.Child().Len())
-		for _, kid := range f.file.Child().Names() {
-			nb += int64(32 + len(kid))
-			// +32 for the storage key. This is just an estimate; the point here
-			// is to have some stable number that approximates how much storage
-			// the directory occupies.
+		// If the number of subdirectories is not known, report 1, which tools
+		// such as find(1) take to mean the count is not maintained.
+		size, subdirs, ok := f.dirSummary()
+		if ok {
+			nlink = uint32(2 + subdirs) // "." and the entry in the parent
 		}
+		nb, stored = size, size
 	} else {
-		nb = f.file.Data().Size()
+		nlink = f.st.linkCount(f.id)
+
+		// Unstored ranges of the file (holes) do not count against its blocks.
+		l := f.layout()
+		nb, stored = l.size, l.stored
 	}
 
 	out.Size = uint64(nb)
-	out.Blocks = uint64((nb + 511) / 512)
+	out.Blocks = uint64((stored + 511) / 512)
+	out.Blksize = statfsBlockSize // N.B. nonzero, or the library overrides Blocks
 	out.Mode = toSysMode(s.Mode)
-	out.Mtime = uint64(s.ModTime.Unix())           // seconds
-	out.Mtimensec = uint32(s.ModTime.Nanosecond()) // nanoseconds within second
+	atime, ctime := fileTimes(f.file())
+	setAttrTime(&out.Atime, &out.Atimensec, atime)
+	setAttrTime(&out.Mtime, &out.Mtimensec, s.ModTime)
+	setAttrTime(&out.Ctime, &out.Ctimensec, ctime)
+	if btime, ok := getTime(f.file(), metaBtime); ok {
+		setBirthTime(out, btime)
+	}
 	out.Owner.Uid = uint32(s.OwnerID)
 	out.Owner.Gid = uint32(s.GroupID)
 	out.Nlink = nlink
+	if s.Mode&os.ModeDevice != 0 {
+		out.Rdev = f.rdev()
+	}
+}
+
+// initFile records the metadata of nf, a newly-created file: the current time
+// as its birth time.
+func initFile(nf *file.File) {
+	setTime(nf, metaBtime, time.Now())
+}
+
+// rdev reports the device number recorded for f, or 0 if none is recorded.
+func (f *FS) rdev() uint32 {
+	v, _ := strconv.ParseUint(f.file().XAttr().Get(metaRdev), 10, 32)
+	return uint32(v)
 }
 
 // Fsync implements the [fs.NodeFsyncer] interface.
 func (f *FS) Fsync(ctx context.Context, fh fs.FileHandle, flags uint32) errno {
-	_, err := f.file.Flush(ctx)
+	_, err := f.file().Flush(ctx)
 	return errorToErrno(err)
 }
 
@@ -193,7 +609,7 @@ func (f *FS) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) e
 			return ga.Getattr(ctx, out)
 		}
 	}
-	f.fillAttr(&out.Attr)
+	f.fillAttr(ctx, &out.Attr)
 	return noError
 }
 
@@ -204,9 +620,36 @@ const (
 	ffsDataHash      = "ffs.dataHash"
 	ffsDataHashB64   = ffsDataHash + ".b64"
 	ffsDataHashHex   = ffsDataHash + ".hex"
+	ffsBlocks        = "ffs.blocks" // data blocks, one per line (hex keys)
+	ffsBlocksB64     = ffsBlocks + ".b64"
+	ffsBlocksHex     = ffsBlocks + ".hex"
+	ffsBlockCount    = "ffs.blockCount" // number of data blocks
+	ffsSplit         = "ffs.split"      // default block splitter settings
 	ffsLinkTo        = "ffs.link."
+	ffsRootTo        = "ffs.root."
+
+	// Driver metadata not represented by file.Stat are stored as extended
+	// attributes with this prefix. These are not visible to the xattr methods.
+	metaPrefix   = "ffuse."
+	metaRdev     = metaPrefix + "rdev"  // device number (decimal)
+	metaLinks    = metaPrefix + "links" // link counts ("<id> <count>" lines, decimal, see inode.go)
+	metaIDPrefix = metaPrefix + "ino/"  // ID of a child, by name ("<id> <dir id>", decimal)
+	metaAtime    = metaPrefix + "atime" // access time (decimal, see times.go)
+	metaCtime    = metaPrefix + "ctime" // change time (decimal)
+	metaBtime    = metaPrefix + "btime" // birth time (decimal)
 )
 
+// isMetaXAttr reports whether name is reserved for driver metadata.
+func isMetaXAttr(name string) bool { return strings.HasPrefix(name, metaPrefix) }
+
+// isVirtualXAttr reports whether name is a virtual attribute computed by the
+// driver, which cannot be set or removed.
+func isVirtualXAttr(name string) bool {
+	return strings.HasPrefix(name, ffsStorageKey) || strings.HasPrefix(name, ffsDataHash) ||
+		strings.HasPrefix(name, ffsBlocks) || name == ffsBlockCount || name == ffsSplit ||
+		strings.HasPrefix(name, ffsTreePrefix)
+}
+
 // xattrEncoding returns an encoding function for the specified xattr name.
 // This should only be used for the "ffs.*" attributes.
 func xattrEncoding(name string) func([]byte) string {
@@ -227,17 +670,37 @@ func (f *FS) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, er
 	switch attr {
 	case ffsStorageKey, ffsStorageKeyB64, ffsStorageKeyHex:
 		encode = xattrEncoding(attr)
-		key, err := f.file.Flush(ctx)
+		key, err := f.file().Flush(ctx)
 		if err != nil {
 			return 0, errorToErrno(err)
 		}
 		buf = append(buf, key...)
 	case ffsDataHash, ffsDataHashB64, ffsDataHashHex:
 		encode = xattrEncoding(attr)
-		buf = append(buf, f.file.Data().Hash()...)
+		buf = append(buf, f.file().Data().Hash()...)
+	case ffsBlocks, ffsBlocksB64, ffsBlocksHex, ffsBlockCount, ffsSplit:
+		if !f.file().Stat().Mode.IsRegular() {
+			return 0, xattrErrnoNotFound
+		}
+		buf = appendBlockXAttr(buf, f.file(), attr)
+	case ffsTreeBytes, ffsTreeFiles, ffsTreeDirs, ffsTreeUniqueBlocks:
+		v, e := f.treeXAttr(ctx, attr)
+		if e != noError {
+			return 0, e
+		}
+		buf = strconv.AppendInt(buf, v, 10)
 	default:
-		xa := f.file.XAttr()
-		if !xa.Has(attr) {
+		if t, ok := strings.CutPrefix(attr, ffsLinkTo); ok {
+			key, enc, e := f.linkKey(ctx, t)
+			if e != noError {
+				return 0, e
+			}
+			encode = enc
+			buf = append(buf, key...)
+			break
+		}
+		xa := f.file().XAttr()
+		if isMetaXAttr(attr) || !xa.Has(attr) {
 			return 0, xattrErrnoNotFound
 		}
 		buf = append(buf, xa.Get(attr)...)
@@ -251,37 +714,106 @@ func (f *FS) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, er
 	return uint32(len(buf)), noError
 }
 
+// childKey returns the storage key of the child name of f, which is the value
+// of the ffs.link.<name> attribute of a directory. The key is in the form
+// accepted by Setxattr for the same attribute name, so that a link can be
+// copied to another directory.
+func (f *FS) childKey(ctx context.Context, name string) (string, errno) {
+	if !f.file().Stat().Mode.IsDir() {
+		return "", xattrErrnoNotFound
+	}
+	kid, err := f.openChild(ctx, name)
+	if errors.Is(err, file.ErrChildNotFound) {
+		return "", xattrErrnoNotFound
+	} else if err != nil {
+		return "", errorToErrno(err)
+	}
+	key, err := kid.Flush(ctx)
+	if err != nil {
+		return "", errorToErrno(err)
+	}
+	return key, noError
+}
+
+// linkKey returns the storage key of the child named by t, the suffix of an
+// ffs.link.<name> attribute read from the directory f, and a function to
+// encode the key, or nil if the key is reported as raw binary.
+//
+// The name is taken literally if f has a child by that name. Otherwise, as
+// for the other "ffs.*" attributes, a ".hex" or ".b64" suffix selects the
+// encoding of the key of the child named by the rest. Only reads accept the
+// suffixes: setting or removing ffs.link.<name> always names the child
+// <name>, and the value set is the raw key.
+func (f *FS) linkKey(ctx context.Context, t string) (string, func([]byte) string, errno) {
+	key, e := f.childKey(ctx, t)
+	if e == xattrErrnoNotFound {
+		if encode := xattrEncoding(t); encode != nil {
+			key, e = f.childKey(ctx, strings.TrimSuffix(t, path.Ext(t)))
+			return key, encode, e
+		}
+	}
+	return key, nil, e
+}
+
 // Link implements the [fs.NodeLinker] interface.
 func (f *FS) Link(ctx context.Context, target fs.InodeEmbedder, name string, out *fuse.EntryOut) (*fs.Inode, errno) {
-	if f.file.Child().Has(name) {
+	f.st.nsMu.Lock()
+	defer f.st.nsMu.Unlock()
+	f.dirMu.Lock()
+	defer f.dirMu.Unlock()
+	if f.hasChild(name) {
 		return nil, syscall.EEXIST // disallow linking over an existing name
+	} else if e := f.checkAddEntry(ctx); e != noError {
+		return nil, e
 	}
 	tf, ok := target.EmbeddedInode().Operations().(*FS)
 	if !ok {
 		return nil, syscall.EIO // not expected to happen
+	} else if tf.st != f.st {
+		return nil, syscall.EXDEV // the target is in another tree
 	}
-	if tf.file.Stat().Mode.IsDir() {
+	if tf.file().Stat().Mode.IsDir() {
 		return nil, syscall.EPERM // disallow hard-linking a directory
 	}
-	f.file.Child().Set(name, tf.file)
-	nfs := &FS{file: tf.file}
-	nfs.fillAttr(&out.Attr)
-	return f.NewInode(ctx, nfs, fileStableAttr(nfs.file)), noError
+	// Both names share the inode of the target, so record its ID.
+	f.addEntry(name, tf.file(), nil)
+	f.setChildID(name, tf.id)
+	f.st.addLinks(tf.id, tf.file(), 1)
+	tf.fillAttr(ctx, &out.Attr)
+	return target.EmbeddedInode(), noError
 }
 
-// addMagicXAttrs appends the names of the "magic" implicit xattrs to data, and
+// maxListedLinks is the largest number of children of a directory for which
+// the ffs.link.<name> attributes are listed.
+const maxListedLinks = 256
+
+// addMagicXAttrs appends the names of the "magic" implicit xattrs to buf, and
 // returns the resulting slice.
 //
-//lint:ignore U1000 Decide if we really want this.
-func (f *FS) addMagicXAttrs(data []byte) []byte {
-	buf := data[:0]
-	buf = addString(buf, ffsStorageKey)
-	buf = addString(buf, ffsStorageKeyB64)
-	buf = addString(buf, ffsStorageKeyHex)
-	if f.file.Stat().Mode.IsRegular() {
+// Only attributes that are cheap to compute and have bounded size are listed,
+// since tools such as "getfattr -d" read every attribute listed. Attributes
+// that flush or scan the tree, such as ffs.storageKey and ffs.tree.*, or
+// that may exceed the size limit of the kernel, such as ffs.blocks, must be
+// requested by name. The ffs.link.<name> attribute of each child is listed,
+// in its raw form, unless the directory has more than maxListedLinks children,
+// since the list would then exceed the size limit of the kernel.
+func (f *FS) addMagicXAttrs(buf []byte) []byte {
+	switch mode := f.file().Stat().Mode; {
+	case mode.IsRegular():
 		buf = addString(buf, ffsDataHash)
 		buf = addString(buf, ffsDataHashB64)
 		buf = addString(buf, ffsDataHashHex)
+		buf = addString(buf, ffsBlockCount)
+		buf = addString(buf, ffsSplit)
+	case mode.IsDir():
+		if f.file().Child().Len() > maxListedLinks {
+			break
+		}
+		for _, name := range f.file().Child().Names() {
+			if len(ffsLinkTo)+len(name) <= xattrNameMax {
+				buf = addString(buf, ffsLinkTo+name)
+			}
+		}
 	}
 	return buf
 }
@@ -295,8 +827,13 @@ func addString(buf []byte, s string) []byte {
 // Listxattr implements the [fs.NodeListxattrer] interface.
 func (f *FS) Listxattr(ctx context.Context, dest []byte) (uint32, errno) {
 	buf := dest[:0]
-	for _, name := range f.file.XAttr().Names() {
-		buf = addString(buf, name)
+	for _, name := range f.file().XAttr().Names() {
+		if !isMetaXAttr(name) {
+			buf = addString(buf, name)
+		}
+	}
+	if f.st.opts.ListVirtualXAttrs {
+		buf = f.addMagicXAttrs(buf)
 	}
 
 	// If len(dest) == 0, this is a request for the total size. Otherwise, if
@@ -309,22 +846,32 @@ func (f *FS) Listxattr(ctx context.Context, dest []byte) (uint32, errno) {
 
 // Lookup implements the [fs.NodeLookuper] interface.
 func (f *FS) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, errno) {
+	if e := f.checkAccess(ctx, permExec); e != noError {
+		return nil, e
+	} else if in := f.controlNode(ctx, name); in != nil {
+		var attr fuse.AttrOut
+		in.Operations().(fs.NodeGetattrer).Getattr(ctx, nil, &attr)
+		out.Attr = attr.Attr
+		return in, noError
+	}
+
 	// Reuse an existing inode allocation, if possible. Note that this is
 	// important for correctness, and not only an optimization.  Without this
 	// check, a caller that opens the same file multiple times may get different
 	// inodes, and consequently may not perceive changes to the underlying File.
-	if c, ok := f.EmbeddedInode().Children()[name]; ok {
-		return c, noError
+	if c := f.liveChild(name); c != nil {
+		c.fillAttr(ctx, &out.Attr)
+		return c.EmbeddedInode(), noError
 	}
-	nf, err := f.file.Open(ctx, name)
+	nf, err := f.openChild(ctx, name)
 	if errors.Is(err, file.ErrChildNotFound) {
 		return nil, syscall.ENOENT
 	} else if err != nil {
 		return nil, errorToErrno(err)
 	}
-	nfs := &FS{file: nf}
-	nfs.fillAttr(&out.Attr)
-	return f.NewInode(ctx, nfs, fileStableAttr(nf)), noError
+	nfs, in := f.newChild(ctx, name, nf)
+	nfs.fillAttr(ctx, &out.Attr)
+	return in, noError
 }
 
 // Mkdir implements the [fs.NodeMkdirer] interface.
@@ -333,10 +880,14 @@ func (f *FS) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.Entr
 	if !ok {
 		return nil, syscall.ENOSYS
 	}
-	if f.file.Child().Has(name) {
+	f.dirMu.Lock()
+	defer f.dirMu.Unlock()
+	if f.hasChild(name) {
 		return nil, syscall.EEXIST
+	} else if e := f.checkAddEntry(ctx); e != noError {
+		return nil, e
 	}
-	nf := f.file.New(&file.NewOptions{
+	nf := f.file().New(&file.NewOptions{
 		Name: name,
 		Stat: &file.Stat{
 			// N.B.: macOS FUSE populates S_IFMT, but Linux FUSE does not, so
@@ -347,46 +898,152 @@ func (f *FS) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.Entr
 			GroupID: int(caller.Gid),
 		},
 	})
-	f.file.Child().Set(name, nf)
-	nfs := &FS{file: nf}
-	nfs.fillAttr(&out.Attr)
-	return f.NewInode(ctx, nfs, fileStableAttr(nf)), noError
+	initFile(nf)
+	f.addEntry(name, nf, nil)
+	nfs, in := f.newChild(ctx, name, nf)
+	nfs.fillAttr(ctx, &out.Attr)
+	return in, noError
+}
+
+// Mknod implements the [fs.NodeMknoder] interface.
+func (f *FS) Mknod(ctx context.Context, name string, mode, dev uint32, out *fuse.EntryOut) (*fs.Inode, errno) {
+	caller, ok := fuse.FromContext(ctx)
+	if !ok {
+		return nil, syscall.ENOSYS
+	}
+	m := fromSysMode(mode, true)
+	switch {
+	case m.IsRegular(), m&(os.ModeNamedPipe|os.ModeSocket|os.ModeDevice) != 0:
+		// OK
+	default:
+		return nil, syscall.EINVAL // directories and symlinks have their own methods
+	}
+	f.dirMu.Lock()
+	defer f.dirMu.Unlock()
+	if f.hasChild(name) {
+		return nil, syscall.EEXIST
+	} else if e := f.checkAddEntry(ctx); e != noError {
+		return nil, e
+	}
+	nf := f.file().New(&file.NewOptions{
+		Name: name,
+		Stat: &file.Stat{
+			Mode:    m,
+			ModTime: time.Now(),
+			OwnerID: int(caller.Uid),
+			GroupID: int(caller.Gid),
+		},
+	})
+	if m&os.ModeDevice != 0 {
+		nf.XAttr().Set(metaRdev, strconv.FormatUint(uint64(dev), 10))
+	}
+	initFile(nf)
+	f.addEntry(name, nf, nil)
+	nfs, in := f.newChild(ctx, name, nf)
+	nfs.fillAttr(ctx, &out.Attr)
+	return in, noError
 }
 
 // Open implements the [fs.NodeOpener] interface.
 func (f *FS) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, errno) {
-	return &fileHandle{fs: f, writable: !isReadOnly(flags), append: flags&syscall.O_APPEND != 0}, 0, noError
+	if e := f.checkAccess(ctx, openMask(flags)); e != noError {
+		return nil, 0, e
+	}
+	return f.open(ctx, flags)
 }
 
-// Readdir implements the [fs.NodeReaddirer] interface.
-func (f *FS) Readdir(ctx context.Context) (fs.DirStream, errno) {
-	kids := f.file.Child()
-	elts := make([]fuse.DirEntry, kids.Len())
-	for i, name := range kids.Names() { // already sorted
-		kid, err := f.file.Open(ctx, name)
-		if err != nil {
-			return nil, errorToErrno(err)
+// open opens a handle to f with the given open flags, and returns the handle
+// and the FUSE open flags for the response.
+func (f *FS) open(ctx context.Context, flags uint32) (*fileHandle, uint32, errno) {
+	if !isReadOnly(flags) || flags&syscall.O_TRUNC != 0 {
+		if e := f.st.checkWritable(); e != noError {
+			return nil, 0, e
 		}
-		elts[i] = fuse.DirEntry{
-			Mode: toSysMode(kid.Stat().Mode),
-			Name: name,
+	}
+	if flags&openNoAtime != 0 {
+		if e := f.checkOwner(ctx); e != noError {
+			return nil, 0, e
+		}
+	}
+
+	// If the request wants the file truncated, do that now.
+	if flags&syscall.O_TRUNC != 0 && f.file().Stat().Mode.IsRegular() {
+		f.fileMu.Lock()
+		err := f.file().Truncate(ctx, 0)
+		f.fileMu.Unlock()
+		if err != nil {
+			return nil, 0, errorToErrno(err)
 		}
 	}
-	return fs.NewListDirStream(elts), noError
+	h := &fileHandle{
+		fs:       f,
+		readable: flags&syscall.O_ACCMODE != syscall.O_WRONLY,
+		writable: !isReadOnly(flags),
+		append:   flags&syscall.O_APPEND != 0,
+		noatime:  flags&openNoAtime != 0,
+	}
+
+	// Direct I/O bypasses the page cache, so there is nothing to keep.
+	if flags&openDirect != 0 {
+		return h, fuse.FOPEN_DIRECT_IO, noError
+	}
+	return h, f.cacheFlags(), noError
+}
+
+// cacheFlags returns the FUSE open flags governing the kernel page cache for
+// an open of f.
+//
+// If the contents of f have not changed since it was last opened, the kernel
+// may keep the pages it has cached. Otherwise the cached pages are stale, and
+// we invalidate them, including those used by handles that are already open.
+func (f *FS) cacheFlags() uint32 {
+	if !f.file().Stat().Mode.IsRegular() {
+		return 0
+	}
+	hash := string(f.file().Data().Hash())
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	old := f.openHash
+	f.openHash = hash
+	if old == hash {
+		return fuse.FOPEN_KEEP_CACHE
+	} else if old != "" {
+		go f.NotifyContent(0, 0) // outside the request
+	}
+	return 0
+}
+
+// OpendirHandle implements the [fs.NodeOpendirHandler] interface.
+func (f *FS) OpendirHandle(ctx context.Context, flags uint32) (fs.FileHandle, uint32, errno) {
+	if e := f.checkAccess(ctx, permRead); e != noError {
+		return nil, 0, e
+	}
+	f.st.touchAccess(f.file())
+	return f.newDirStream(ctx), 0, noError
+}
+
+// Readdir implements the [fs.NodeReaddirer] interface.
+func (f *FS) Readdir(ctx context.Context) (fs.DirStream, errno) {
+	if e := f.checkAccess(ctx, permRead); e != noError {
+		return nil, e
+	}
+	f.st.touchAccess(f.file())
+	return f.newDirStream(ctx), noError
 }
 
 // Readlink implements the [fs.NodeReadlinker] interface.
 func (f *FS) Readlink(ctx context.Context) ([]byte, errno) {
-	buf := make([]byte, int(f.file.Data().Size()))
-	if _, err := f.file.ReadAt(ctx, buf, 0); err != nil {
+	buf := make([]byte, int(f.file().Data().Size()))
+	if _, err := f.file().ReadAt(ctx, buf, 0); err != nil {
 		return nil, errorToErrno(err)
 	}
+	f.st.touchAccess(f.file())
 	return buf, noError
 }
 
 // Removexattr implements the [fs.NodeRemovexattrer] interface.
 func (f *FS) Removexattr(ctx context.Context, attr string) errno {
-	if strings.HasPrefix(attr, ffsStorageKey) || strings.HasPrefix(attr, ffsDataHash) {
+	if isVirtualXAttr(attr) || isMetaXAttr(attr) {
 		return syscall.EPERM // virtual attributes, not writable
 	}
 
@@ -394,32 +1051,68 @@ func (f *FS) Removexattr(ctx context.Context, attr string) errno {
 	// to be unlinked as a child of f, regardless of its type. This differs from
 	// Unlink in that it can immediately unlink a complete directory.
 	if t, ok := strings.CutPrefix(attr, ffsLinkTo); ok {
-		if !f.file.Stat().Mode.IsDir() {
+		if !f.file().Stat().Mode.IsDir() {
 			return syscall.EPERM
 		}
-		if !f.file.Child().Remove(t) {
+		f.st.nsMu.Lock()
+		defer f.st.nsMu.Unlock()
+		defer lockDirs(f, f.liveChild(t))()
+		uf, err := f.openChild(ctx, t)
+		if errors.Is(err, file.ErrChildNotFound) {
 			return xattrErrnoNotFound
+		} else if err != nil {
+			return errorToErrno(err)
+		} else if e := f.checkRemoveEntry(ctx, uf); e != noError {
+			return e
 		}
+		f.removeEntry(t, uf)
 		go f.NotifyEntry(t) // outside the lock
 		return noError
 	}
-	xa := f.file.XAttr()
+	if e := f.checkSetxattr(ctx, attr); e != noError {
+		return e
+	}
+	f.fileMu.Lock()
+	defer f.fileMu.Unlock()
+	xa := f.file().XAttr()
 	if !xa.Has(attr) {
 		return xattrErrnoNotFound
 	}
 	xa.Remove(attr)
+	touchChange(f.file())
 	return noError
 }
 
+// Flags for Rename, as defined for renameat2(2).
+// These are not exposed in the syscall package.
+const (
+	renameNoReplace = 0x1 // RENAME_NOREPLACE
+	renameExchange  = 0x2 // RENAME_EXCHANGE
+)
+
 // Rename implements the [fs.NodeRenamer] interface.
 func (f *FS) Rename(ctx context.Context, name string, newParent fs.InodeEmbedder, newName string, flags uint32) errno {
 	np, ok := newParent.EmbeddedInode().Operations().(*FS)
 	if !ok {
 		return syscall.ENOSYS
+	} else if np.st != f.st {
+		return syscall.EXDEV // the new parent is in another tree
+	}
+	switch flags {
+	case 0, renameNoReplace, renameExchange:
+		// OK
+	default:
+		return syscall.EINVAL // including RENAME_WHITEOUT
 	}
+	if f.isControlName(name) || np.isControlName(newName) {
+		return syscall.EPERM // the control directory cannot be moved or replaced
+	}
+	f.st.nsMu.Lock()
+	defer f.st.nsMu.Unlock()
+	defer lockDirs(f, np, np.liveChild(newName))()
 
 	// The file to be renamed. We need its stat for type checks below.
-	cf, err := f.file.Open(ctx, name)
+	cf, err := f.openChild(ctx, name)
 	if errors.Is(err, file.ErrChildNotFound) {
 		return syscall.ENOENT
 	} else if err != nil {
@@ -429,11 +1122,34 @@ func (f *FS) Rename(ctx context.Context, name string, newParent fs.InodeEmbedder
 	// Type checks: Files may not replace directories and vice versa.  Moreover,
 	// we can only replace an existing directory with another directory, and
 	// only if the target is empty.
-	tf, err := np.file.Open(ctx, newName)
+	tf, err := np.openChild(ctx, newName)
 	if errors.Is(err, file.ErrChildNotFound) {
-		// OK, target does not exist
+		// OK, target does not exist, unless we are exchanging.
+		if flags == renameExchange {
+			return syscall.ENOENT
+		}
 	} else if err != nil {
 		return errorToErrno(err)
+	} else if tf == cf {
+		return noError // both names refer to the same file; do nothing
+	} else if flags == renameNoReplace {
+		return syscall.EEXIST
+	} else if flags == renameExchange {
+		// Exchange does not replace either file, so types need not match.
+		if e := f.checkRename(ctx, np, cf, tf, true); e != noError {
+			return e
+		}
+		cid, tid := f.childID(name), np.childID(newName)
+		exchangeChildren(f.file(), name, cf, np.file(), newName, tf)
+		f.moveChildID(name, tid)
+		np.moveChildID(newName, cid)
+		f.noteEntry(name, cf, -1)
+		f.noteEntry(name, tf, 1)
+		np.noteEntry(newName, tf, -1)
+		np.noteEntry(newName, cf, 1)
+		touchChange(cf)
+		touchChange(tf)
+		return noError
 	} else if tf.Stat().Mode.IsDir() {
 		// Replacement of an existing directory is allowed only if the source is
 		// also a directory, and the target is empty.
@@ -444,40 +1160,80 @@ func (f *FS) Rename(ctx context.Context, name string, newParent fs.InodeEmbedder
 		// Disallow replacement of a non-directory file with a directory.
 		return syscall.EEXIST
 	}
-	return errorToErrno(file.Move(f.file, name, np.file, newName))
+	if e := f.checkRename(ctx, np, cf, tf, false); e != noError {
+		return e
+	}
+	cid, tid := f.childID(name), np.childID(newName)
+	if err := file.Move(f.file(), name, np.file(), newName); err != nil {
+		return errorToErrno(err)
+	}
+	f.clearChildID(name)
+	np.moveChildID(newName, cid) // keep its inode number under the new name
+	f.noteEntry(name, cf, -1)
+	np.noteEntry(newName, cf, 1)
+	touchChange(cf)
+	if tf != nil {
+		np.noteEntry(newName, tf, -1)
+		f.st.addLinks(tid, tf, -1) // the target was replaced
+	}
+	return noError
+}
+
+// exchangeChildren swaps af, the child aName of a, with bf, the child bName
+// of b. The caller must hold the directory locks of a and b.
+//
+// Each entry is replaced in turn, so a concurrent flush of the tree, such as
+// an automatic flush or a read of the ffs.storageKey attribute, may store the
+// intermediate state in which bf has both names, but never a tree in which
+// either file is missing.
+func exchangeChildren(a *file.File, aName string, af *file.File, b *file.File, bName string, bf *file.File) {
+	a.Child().Set(aName, bf)
+	b.Child().Set(bName, af)
 }
 
 // Rmdir implements the [fs.NodeRmdirer] interface.
 func (f *FS) Rmdir(ctx context.Context, name string) errno {
-	uf, err := f.file.Open(ctx, name)
+	f.st.nsMu.Lock()
+	defer f.st.nsMu.Unlock()
+	defer lockDirs(f, f.liveChild(name))()
+	uf, err := f.file().Open(ctx, name)
 	if errors.Is(err, file.ErrChildNotFound) {
 		return syscall.ENOENT
 	} else if err != nil {
 		return errorToErrno(err)
 	}
+	f.noteLoaded(name)
 
 	if uf.Child().Len() != 0 {
 		return syscall.ENOTEMPTY
+	} else if e := f.checkRemoveEntry(ctx, uf); e != noError {
+		return e
 	}
 
 	// Note we already checked for existence above, so don't check again.
-	f.file.Child().Remove(name)
+	f.removeEntry(name, uf)
 	return noError
 }
 
 // Setattr implements the [fs.NodeSetattrer] interface.
-func (f *FS) Setattr(ctx context.Context, _ fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) errno {
+func (f *FS) Setattr(ctx context.Context, fh fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) errno {
+	f.fileMu.Lock()
+	defer f.fileMu.Unlock()
+	if e := f.checkSetattr(ctx, fh, in); e != noError {
+		return e
+	}
+
 	// Update the fields of the stat marked as valid in the request.
 	//
 	// Setting stat cannot fail unless it changes the size of the file, so we
 	// will check that first.
 	if sz, ok := in.GetSize(); ok {
-		if err := f.file.Truncate(ctx, int64(sz)); err != nil {
+		if err := f.file().Truncate(ctx, int64(sz)); err != nil {
 			return errorToErrno(err)
 		}
 	}
 
-	s := f.file.Stat()
+	s := f.file().Stat()
 	if id, ok := in.GetGID(); ok {
 		s.GroupID = int(id)
 	}
@@ -490,43 +1246,48 @@ func (f *FS) Setattr(ctx context.Context, _ fs.FileHandle, in *fuse.SetAttrIn, o
 	if mt, ok := in.GetMTime(); ok {
 		s.ModTime = mt
 	}
+	if at, ok := in.GetATime(); ok {
+		setTime(f.file(), metaAtime, at)
+	}
 	s.Update()
-	f.fillAttr(&out.Attr)
+	touchChange(f.file())
+	f.fillAttr(ctx, &out.Attr)
 	return noError
 }
 
 // Setxattr implements the [fs.NodeSetxattrer] interface.
 func (f *FS) Setxattr(ctx context.Context, attr string, data []byte, flags uint32) errno {
-	if strings.HasPrefix(attr, ffsStorageKey) || strings.HasPrefix(attr, ffsDataHash) {
+	if isVirtualXAttr(attr) || isMetaXAttr(attr) {
 		return syscall.EPERM // virtual attributes, not writable
+	} else if attr == ffsLinks {
+		return f.setLinks(ctx, data)
+	} else if attr == ffsSnapshot {
+		return f.snapshot(ctx, data, flags)
 	}
 
 	// If f is a directory, then setting ffs.link.<name> on f causes <name> to
 	// be set or replaced as a child of f, pointing to the file whose storage
-	// key is given in the value.
+	// key is given in the value, as raw binary.
 	if t, ok := strings.CutPrefix(attr, ffsLinkTo); ok {
-		if !f.file.Stat().Mode.IsDir() {
-			return syscall.EPERM // only allow linking in a directory
-		} else if t == "" || strings.ContainsAny(t, "/\x00") {
-			return syscall.EINVAL // disallow empty names, directory separators, NUL
-		}
-		exists := f.file.Child().Has(t)
-		if exists && flags&xattrCreate != 0 {
-			return syscall.EEXIST
-		} else if !exists && flags&xattrReplace != 0 {
-			return xattrErrnoNotFound
-		}
+		return f.setLink(ctx, t, string(data), flags)
+	}
 
-		tf, err := f.file.Load(ctx, string(data))
-		if err != nil {
-			return syscall.ENOENT
+	// Similarly, setting ffs.root.<name> links the file named by a root
+	// pointer, optionally followed by a path, as in "root:path/to/file".
+	if t, ok := strings.CutPrefix(attr, ffsRootTo); ok {
+		key, e := f.rootFileKey(ctx, string(data))
+		if e != noError {
+			return e
 		}
-		f.file.Child().Set(t, tf)
-		go f.NotifyEntry(t) // outside the lock
-		return noError
+		return f.setLink(ctx, t, key, flags)
 	}
 
-	xa := f.file.XAttr()
+	if e := f.checkSetxattr(ctx, attr); e != noError {
+		return e
+	}
+	f.fileMu.Lock()
+	defer f.fileMu.Unlock()
+	xa := f.file().XAttr()
 	exists := xa.Has(attr)
 	if exists && flags&xattrCreate != 0 {
 		return syscall.EEXIST // create, but it already exists
@@ -534,6 +1295,49 @@ func (f *FS) Setxattr(ctx context.Context, attr string, data []byte, flags uint3
 		return xattrErrnoNotFound // replace, but it doesn't exist
 	}
 	xa.Set(attr, string(data))
+	touchChange(f.file())
+	return noError
+}
+
+const (
+	// statfsBlockSize is the nominal block size reported by Statfs.
+	statfsBlockSize = 4096
+
+	// statfsUnknown is reported by Statfs for a value that is not known.
+	// Tools such as df treat a field with all bits set as unknown.
+	statfsUnknown = ^uint64(0)
+)
+
+// Statfs implements the [fs.NodeStatfser] interface.
+//
+// Tools such as df(1) call Statfs often, so it does not flush the tree, and
+// the usage it reports is that of the tree as of its last flush.
+func (f *FS) Statfs(ctx context.Context, out *fuse.StatfsOut) errno {
+	u, err := f.st.treeUsage(ctx)
+	if err != nil {
+		return errorToErrno(err)
+	}
+	out.Bsize = statfsBlockSize
+	out.Frsize = statfsBlockSize
+	out.NameLen = 255
+	out.Files = uint64(u.files + u.dirs)
+	out.Ffree = statfsUnknown
+
+	// If the store can report its capacity, use that. Otherwise, report the
+	// space used by the tree as the total, and the free space as unknown.
+	if cr := f.st.opts.Capacity; cr != nil {
+		total, avail, err := cr.Capacity(ctx)
+		if err != nil {
+			return errorToErrno(err)
+		}
+		out.Blocks = uint64(total / statfsBlockSize)
+		out.Bfree = uint64(avail / statfsBlockSize)
+		out.Bavail = out.Bfree
+	} else {
+		out.Blocks = uint64((u.bytes + statfsBlockSize - 1) / statfsBlockSize)
+		out.Bfree = statfsUnknown
+		out.Bavail = statfsUnknown
+	}
 	return noError
 }
 
@@ -543,10 +1347,14 @@ func (f *FS) Symlink(ctx context.Context, target, name string, out *fuse.EntryOu
 	if !ok {
 		return nil, syscall.ENOSYS
 	}
-	if f.file.Child().Has(name) {
+	f.dirMu.Lock()
+	defer f.dirMu.Unlock()
+	if f.hasChild(name) {
 		return nil, syscall.EEXIST
+	} else if e := f.checkAddEntry(ctx); e != noError {
+		return nil, e
 	}
-	nf := f.file.New(&file.NewOptions{
+	nf := f.file().New(&file.NewOptions{
 		Name: name,
 		Stat: &file.Stat{
 			Mode:    os.ModeSymlink | 0555,
@@ -557,15 +1365,19 @@ func (f *FS) Symlink(ctx context.Context, target, name string, out *fuse.EntryOu
 	if _, err := nf.WriteAt(ctx, []byte(target), 0); err != nil {
 		return nil, errorToErrno(err)
 	}
-	f.file.Child().Set(name, nf)
-	nfs := &FS{file: nf}
-	nfs.fillAttr(&out.Attr)
-	return f.NewInode(ctx, nfs, fileStableAttr(nf)), noError
+	initFile(nf)
+	f.addEntry(name, nf, nil)
+	nfs, in := f.newChild(ctx, name, nf)
+	nfs.fillAttr(ctx, &out.Attr)
+	return in, noError
 }
 
 // Unlink implements the [fs.NodeUnlinker] interface.
 func (f *FS) Unlink(ctx context.Context, name string) errno {
-	uf, err := f.file.Open(ctx, name)
+	f.st.nsMu.Lock()
+	defer f.st.nsMu.Unlock()
+	defer lockDirs(f, f.liveChild(name))()
+	uf, err := f.openChild(ctx, name)
 	if errors.Is(err, file.ErrChildNotFound) {
 		return syscall.ENOENT
 	} else if err != nil {
@@ -575,19 +1387,26 @@ func (f *FS) Unlink(ctx context.Context, name string) errno {
 	// POSIX wants us not to allow removal of non-empty directories.
 	if uf.Stat().Mode.IsDir() && uf.Child().Len() != 0 {
 		return syscall.ENOTEMPTY
+	} else if e := f.checkRemoveEntry(ctx, uf); e != noError {
+		return e
 	}
 
 	// Note we already checked for existence above, so don't check again.
-	f.file.Child().Remove(name)
+	f.removeEntry(name, uf)
 	return noError
 }
 
 // Verify that filehandles support interfaces required by the FUSE integration.
 var (
+	_ fs.FileAllocater = &fileHandle{}
 	_ fs.FileGetattrer = &fileHandle{}
+	_ fs.FileGetlker   = &fileHandle{}
+	_ fs.FileLseeker   = &fileHandle{}
 	_ fs.FileReader    = &fileHandle{}
 	_ fs.FileReleaser  = &fileHandle{}
 	_ fs.FileFlusher   = &fileHandle{}
+	_ fs.FileSetlker   = &fileHandle{}
+	_ fs.FileSetlkwer  = &fileHandle{}
 	_ fs.FileWriter    = &fileHandle{}
 )
 
@@ -596,45 +1415,151 @@ var (
 // equivalent contents, will not collide. That is necessary to prevent a close
 // of one filehandle from invalidating others with the same settings.
 type fileHandle struct {
-	fs               *FS
-	writable, append bool
+	fs                 *FS
+	readable, writable bool
+	append             bool
+	noatime            bool // do not update the access time on reads
+}
+
+// Mode flags for Allocate in the FUSE protocol.
+// These are not exposed in the syscall package.
+const (
+	fallocKeepSize  = 0x01 // FALLOC_FL_KEEP_SIZE
+	fallocPunchHole = 0x02 // FALLOC_FL_PUNCH_HOLE
+	fallocZeroRange = 0x10 // FALLOC_FL_ZERO_RANGE
+)
+
+// Allocate implements the [fs.FileAllocater] interface.
+//
+// Storage for file data is allocated on demand, so preallocation only extends
+// the file. Punching a hole or zeroing a range writes zeroes over the range,
+// which releases the storage for any blocks that become entirely zero. A range
+// that ends past the largest file offset is refused with EFBIG.
+func (h *fileHandle) Allocate(ctx context.Context, off, size uint64, mode uint32) errno {
+	if !h.writable {
+		return syscall.EBADF
+	} else if off > math.MaxInt64 || size > math.MaxInt64-off {
+		return syscall.EFBIG
+	} else if e := h.fs.st.checkWritable(); e != noError {
+		return e
+	}
+	h.fs.fileMu.Lock()
+	defer h.fs.fileMu.Unlock()
+	f := h.fs.file()
+	lo, hi := int64(off), int64(off+size)
+	cur := f.Data().Size()
+	var changed bool
+	switch mode &^ fallocKeepSize {
+	case 0:
+		// Nothing to allocate.
+	case fallocPunchHole:
+		if mode&fallocKeepSize == 0 {
+			return syscall.EOPNOTSUPP // as ext4, punching requires KEEP_SIZE
+		}
+		fallthrough
+	case fallocZeroRange:
+		if err := h.fs.zeroRange(ctx, lo, min(hi, cur)); err != nil {
+			return errorToErrno(err)
+		}
+		changed = lo < cur
+	default:
+		return syscall.EOPNOTSUPP // collapse, insert, unshare
+	}
+	if mode&fallocKeepSize == 0 && hi > cur {
+		if err := f.Truncate(ctx, hi); err != nil {
+			return errorToErrno(err)
+		}
+		changed = true
+	}
+	if changed {
+		h.touch()
+	}
+	return noError
 }
 
 // Getattr implements the [fs.FileGetattrer] interface.
-func (h fileHandle) Getattr(ctx context.Context, out *fuse.AttrOut) errno {
-	h.fs.fillAttr(&out.Attr)
+func (h *fileHandle) Getattr(ctx context.Context, out *fuse.AttrOut) errno {
+	h.fs.fillAttr(ctx, &out.Attr)
 	return noError
 }
 
+// Whence values for Lseek in the FUSE protocol.
+// These are not exposed in the syscall package.
+const (
+	seekData = 3 // SEEK_DATA
+	seekHole = 4 // SEEK_HOLE
+)
+
+// Lseek implements the [fs.FileLseeker] interface. It supports only seeking
+// for data and holes; other seeks are handled by the kernel.
+func (h *fileHandle) Lseek(ctx context.Context, off uint64, whence uint32) (uint64, errno) {
+	l := h.fs.layout()
+	pos := int64(off)
+	if pos >= l.size {
+		return 0, syscall.ENXIO
+	}
+	switch whence {
+	case seekData:
+		for _, sp := range l.spans {
+			if pos < sp.end {
+				return uint64(max(pos, sp.base)), noError
+			}
+		}
+		return 0, syscall.ENXIO // no data after pos
+
+	case seekHole:
+		for _, sp := range l.spans {
+			if pos < sp.base {
+				break // pos is in a hole
+			} else if pos < sp.end {
+				pos = sp.end // skip to the end of the span
+			}
+		}
+		return uint64(min(pos, l.size)), noError // N.B. EOF is an implicit hole
+
+	default:
+		return 0, syscall.ENOTSUP
+	}
+}
+
 // Read implements the [fs.FileReader] interface.
-func (h fileHandle) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, errno) {
-	nr, err := h.fs.file.ReadAt(ctx, dest, off)
+func (h *fileHandle) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, errno) {
+	nr, err := h.fs.file().ReadAt(ctx, dest, off)
 	if err != nil && err != io.EOF {
 		// read(2) signals EOF by returning 0 bytes, but io.ReaderAt requires
 		// that any short read report an error. We don't want to propagate that
 		// error back to FUSE, however, because that will turn into EIO.
 		return nil, errorToErrno(err)
 	}
+	if !h.noatime {
+		h.fs.st.touchAccess(h.fs.file())
+	}
 	return fuse.ReadResultData(dest[:nr]), noError
 }
 
 // Release implements the [fs.FileReleaser] interface.
-func (h fileHandle) Release(ctx context.Context) errno {
-	h.fs.file.Child().Release() // un-pin cached child files
+func (h *fileHandle) Release(ctx context.Context) errno {
+	h.fs.file().Child().Release() // un-pin cached child files
+	h.fs.locks.release(h)         // drop any locks acquired via h
 	return errorToErrno(nil)
 }
 
-func (h fileHandle) touch() { h.fs.file.Stat().WithModTime(time.Now()).Update() }
+func (h *fileHandle) touch() { h.fs.file().Stat().WithModTime(time.Now()).Update() }
 
 // Write implements the [fs.FileWriter] interface.
-func (h fileHandle) Write(ctx context.Context, data []byte, off int64) (uint32, errno) {
+func (h *fileHandle) Write(ctx context.Context, data []byte, off int64) (uint32, errno) {
 	if !h.writable {
-		return 0, syscall.EPERM
-	} else if h.append {
+		return 0, syscall.EBADF
+	} else if e := h.fs.st.checkWritable(); e != noError {
+		return 0, e
+	}
+	h.fs.fileMu.Lock()
+	defer h.fs.fileMu.Unlock()
+	if h.append {
 		// If the file is open for appending, ignore the requested offset.
-		off = h.fs.file.Data().Size()
+		off = h.fs.file().Data().Size()
 	}
-	nw, err := h.fs.file.WriteAt(ctx, data, off)
+	nw, err := h.fs.file().WriteAt(ctx, data, off)
 	if nw > 0 {
 		h.touch()
 	}
@@ -642,8 +1567,8 @@ func (h fileHandle) Write(ctx context.Context, data []byte, off int64) (uint32,
 }
 
 // Flush implements the [fs.FileFlusher] interface.
-func (h fileHandle) Flush(ctx context.Context) errno {
-	_, err := h.fs.file.Flush(ctx)
+func (h *fileHandle) Flush(ctx context.Context) errno {
+	_, err := h.fs.file().Flush(ctx)
 	return errorToErrno(err)
 }
 
@@ -659,10 +1584,6 @@ func errorToErrno(err error) errno {
 	return fs.ToErrno(err)
 }
 
-func fileStableAttr(file *file.File) fs.StableAttr {
-	return fs.StableAttr{Mode: modeFileType(file.Stat().Mode)}
-}
-
 func isReadOnly(flags uint32) bool {
 	return flags&syscall.O_RDWR == 0 && flags&syscall.O_WRONLY == 0
 }
@@ -679,6 +1600,7 @@ func toSysMode(m os.FileMode) uint32 {
 	switch {
 	// Check common cases early.
 	case m.IsRegular():
+		base |= syscall.S_IFREG
 	case m.IsDir():
 		base |= syscall.S_IFDIR
 	case m&os.ModeSymlink != 0:
@@ -716,22 +1638,23 @@ func fromSysMode(m uint32, withType bool) os.FileMode {
 		base |= os.ModeSticky
 	}
 	if withType {
-		switch {
-		// Check common cases early.
-		case m&syscall.S_IFREG != 0:
+		// N.B. The file type is an enumeration, not a bit mask, so we must
+		// compare the whole field. Some callers do not populate the type (for
+		// example, mkdir on Linux); treat that as a regular file.
+		switch m & syscall.S_IFMT {
+		case syscall.S_IFREG, 0:
 			// OK, this is the default.
-		case m&syscall.S_IFDIR != 0:
+		case syscall.S_IFDIR:
 			base |= os.ModeDir
-		case m&syscall.S_IFLNK != 0:
+		case syscall.S_IFLNK:
 			base |= os.ModeSymlink
-
-		case m&syscall.S_IFSOCK != 0:
+		case syscall.S_IFSOCK:
 			base |= os.ModeSocket
-		case m&syscall.S_IFIFO != 0:
+		case syscall.S_IFIFO:
 			base |= os.ModeNamedPipe
-		case m&syscall.S_IFCHR != 0:
+		case syscall.S_IFCHR:
 			base |= os.ModeDevice | os.ModeCharDevice
-		case m&syscall.S_IFBLK != 0:
+		case syscall.S_IFBLK:
 			base |= os.ModeDevice
 		default:
 			base |= os.ModeIrregular // "something else"
@@ -1,7 +1,445 @@
 package ffuse_test
 
-import "testing"
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+
+	"github.com/creachadair/ffs/blob/memstore"
+	"github.com/creachadair/ffs/file"
+	"github.com/creachadair/ffs/filetree"
+	"github.com/creachadair/ffuse"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
 
 func TestSmoke(t *testing.T) {
 	t.Log("TODO: Add real tests. For now just make sure it builds.")
 }
+
+// newTestFS constructs an empty FS backed by an in-memory store, and returns
+// its root along with a context for requests to it.
+func newTestFS(t *testing.T) (*ffuse.FS, context.Context) {
+	t.Helper()
+	return newTestFSOptions(t, nil)
+}
+
+// newTestFSOptions is as newTestFS, but uses the given options. If opts.Store
+// is not valid, it is set to the in-memory store.
+func newTestFSOptions(t *testing.T, opts *ffuse.Options) (*ffuse.FS, context.Context) {
+	t.Helper()
+	if opts == nil {
+		opts = new(ffuse.Options)
+	}
+	if !opts.Store.IsValid() {
+		st, err := filetree.NewStore(t.Context(), memstore.New(nil))
+		if err != nil {
+			t.Fatalf("NewStore: %v", err)
+		}
+		opts.Store = st
+	}
+	root := file.New(opts.Store.Files(), &file.NewOptions{
+		Stat:        &file.Stat{Mode: os.ModeDir | 0755},
+		PersistStat: true,
+	})
+	fsys := ffuse.New(root, opts)
+	fs.NewNodeFS(fsys, &fs.Options{})
+	ctx := fuse.NewContext(t.Context(), &fuse.Caller{Owner: fuse.Owner{Uid: 1000, Gid: 1000}})
+	return fsys, ctx
+}
+
+const numWorkers = 16
+
+// TestConcurrentCreate checks that when several callers concurrently create
+// the same name, exactly one of them succeeds.
+func TestConcurrentCreate(t *testing.T) {
+	tests := []struct {
+		name   string
+		create func(ctx context.Context, dir *ffuse.FS, name string) syscall.Errno
+	}{
+		{"Create", func(ctx context.Context, dir *ffuse.FS, name string) syscall.Errno {
+			_, _, _, e := dir.Create(ctx, name, syscall.O_CREAT|syscall.O_EXCL|syscall.O_WRONLY, 0644, new(fuse.EntryOut))
+			return e
+		}},
+		{"Mkdir", func(ctx context.Context, dir *ffuse.FS, name string) syscall.Errno {
+			_, e := dir.Mkdir(ctx, name, 0755, new(fuse.EntryOut))
+			return e
+		}},
+		{"Mknod", func(ctx context.Context, dir *ffuse.FS, name string) syscall.Errno {
+			_, e := dir.Mknod(ctx, name, syscall.S_IFIFO|0644, 0, new(fuse.EntryOut))
+			return e
+		}},
+		{"Symlink", func(ctx context.Context, dir *ffuse.FS, name string) syscall.Errno {
+			_, e := dir.Symlink(ctx, "target", name, new(fuse.EntryOut))
+			return e
+		}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			root, ctx := newTestFS(t)
+			for i := range 20 {
+				name := fmt.Sprintf("file%d", i)
+				var wg sync.WaitGroup
+				var ok atomic.Int32
+				for range numWorkers {
+					wg.Go(func() {
+						switch e := tc.create(ctx, root, name); e {
+						case 0:
+							ok.Add(1)
+						case syscall.EEXIST:
+							// OK, another worker won
+						default:
+							t.Errorf("Create %q: unexpected error: %v", name, e)
+						}
+					})
+				}
+				wg.Wait()
+				if n := ok.Load(); n != 1 {
+					t.Errorf("Create %q: got %d successes, want 1", name, n)
+				}
+			}
+		})
+	}
+}
+
+// TestConcurrentAppend checks that concurrent appends do not overwrite each
+// other.
+func TestConcurrentAppend(t *testing.T) {
+	root, ctx := newTestFS(t)
+	in, _, _, e := root.Create(ctx, "log", syscall.O_CREAT|syscall.O_WRONLY, 0644, new(fuse.EntryOut))
+	if e != 0 {
+		t.Fatalf("Create: %v", e)
+	}
+	node := in.Operations().(*ffuse.FS)
+
+	const numRecords = 100
+	record := func(w, i int) string { return fmt.Sprintf("%02d:%04d\n", w, i) }
+	var wg sync.WaitGroup
+	for w := range numWorkers {
+		wg.Go(func() {
+			fh, _, e := node.Open(ctx, syscall.O_WRONLY|syscall.O_APPEND)
+			if e != 0 {
+				t.Errorf("Open: %v", e)
+				return
+			}
+			for i := range numRecords {
+				if _, e := fh.(fs.FileWriter).Write(ctx, []byte(record(w, i)), 0); e != 0 {
+					t.Errorf("Write: %v", e)
+					return
+				}
+			}
+		})
+	}
+	wg.Wait()
+
+	fh, _, e := node.Open(ctx, syscall.O_RDONLY)
+	if e != 0 {
+		t.Fatalf("Open: %v", e)
+	}
+	buf := make([]byte, 2*numWorkers*numRecords*len(record(0, 0)))
+	rr, e := fh.(fs.FileReader).Read(ctx, buf, 0)
+	if e != 0 {
+		t.Fatalf("Read: %v", e)
+	}
+	data, _ := rr.Bytes(buf)
+	if want := numWorkers * numRecords * len(record(0, 0)); len(data) != want {
+		t.Errorf("Got %d bytes, want %d", len(data), want)
+	}
+	for w := range numWorkers {
+		for i := range numRecords {
+			if n := bytes.Count(data, []byte(record(w, i))); n != 1 {
+				t.Errorf("Record %q appears %d times, want 1", record(w, i), n)
+			}
+		}
+	}
+}
+
+// TestConcurrentRename checks that concurrent renames between directories
+// neither lose nor duplicate files.
+func TestConcurrentRename(t *testing.T) {
+	root, ctx := newTestFS(t)
+	var dirs [2]*ffuse.FS
+	for i, name := range []string{"a", "b"} {
+		in, e := root.Mkdir(ctx, name, 0755, new(fuse.EntryOut))
+		if e != 0 {
+			t.Fatalf("Mkdir %q: %v", name, e)
+		}
+		dirs[i] = in.Operations().(*ffuse.FS)
+	}
+
+	const numFiles = 8
+	for i := range numFiles {
+		name := fmt.Sprintf("f%d", i)
+		if _, _, _, e := dirs[0].Create(ctx, name, syscall.O_CREAT|syscall.O_WRONLY, 0644, new(fuse.EntryOut)); e != 0 {
+			t.Fatalf("Create %q: %v", name, e)
+		}
+	}
+
+	// Each worker repeatedly moves every file from one directory to the other.
+	// Workers race for the same files, so a rename may find its source gone,
+	// or its target taken.
+	var wg sync.WaitGroup
+	for w := range numWorkers {
+		wg.Go(func() {
+			for i := range 50 {
+				src, dst := dirs[(w+i)%2], dirs[(w+i+1)%2]
+				for j := range numFiles {
+					name := fmt.Sprintf("f%d", j)
+					switch e := src.Rename(ctx, name, dst, name, 0); e {
+					case 0, syscall.ENOENT:
+						// OK
+					default:
+						t.Errorf("Rename %q: unexpected error: %v", name, e)
+					}
+				}
+			}
+		})
+	}
+	wg.Wait()
+
+	for i := range numFiles {
+		name := fmt.Sprintf("f%d", i)
+		var found int
+		for _, d := range dirs {
+			if _, e := d.Lookup(ctx, name, new(fuse.EntryOut)); e == 0 {
+				found++
+			}
+		}
+		if found != 1 {
+			t.Errorf("File %q found in %d directories, want 1", name, found)
+		}
+	}
+}
+
+// Flags for Rename, from renameat2(2).
+const (
+	renameNoReplace = 0x1 // RENAME_NOREPLACE
+	renameExchange  = 0x2 // RENAME_EXCHANGE
+	renameWhiteout  = 0x4 // RENAME_WHITEOUT
+)
+
+func TestRenameFlags(t *testing.T) {
+	root, ctx := newTestFS(t)
+	a, b := makeDir(t, ctx, root, "a"), makeDir(t, ctx, root, "b")
+	createFile(t, ctx, a, "x", "apple")
+	createFile(t, ctx, b, "y", "banana")
+	makeDir(t, ctx, b, "sub")
+
+	// RENAME_NOREPLACE fails if the target exists.
+	if e := a.Rename(ctx, "x", b, "y", renameNoReplace); e != syscall.EEXIST {
+		t.Errorf("Rename NOREPLACE over y: got %v, want %v", e, syscall.EEXIST)
+	}
+	if e := a.Rename(ctx, "x", b, "x", renameNoReplace); e != 0 {
+		t.Errorf("Rename NOREPLACE to x: %v", e)
+	} else if e := b.Rename(ctx, "x", a, "x", 0); e != 0 {
+		t.Fatalf("Rename back: %v", e)
+	}
+
+	// RENAME_EXCHANGE swaps entries in different directories, of any type,
+	// and fails if the target does not exist.
+	if e := a.Rename(ctx, "x", b, "y", renameExchange); e != 0 {
+		t.Fatalf("Rename EXCHANGE x, y: %v", e)
+	}
+	if got := readFile(t, ctx, lookup(t, ctx, a, "x")); got != "banana" {
+		t.Errorf("After exchange, a/x is %q, want banana", got)
+	}
+	if got := readFile(t, ctx, lookup(t, ctx, b, "y")); got != "apple" {
+		t.Errorf("After exchange, b/y is %q, want apple", got)
+	}
+	if e := a.Rename(ctx, "x", b, "sub", renameExchange); e != 0 {
+		t.Errorf("Rename EXCHANGE file and directory: %v", e)
+	}
+	if e := a.Rename(ctx, "x", b, "nonesuch", renameExchange); e != syscall.ENOENT {
+		t.Errorf("Rename EXCHANGE with a missing target: got %v, want %v", e, syscall.ENOENT)
+	}
+
+	// Other flags, and combinations, are not supported.
+	for _, flags := range []uint32{renameWhiteout, renameNoReplace | renameExchange, 0x8} {
+		if e := a.Rename(ctx, "x", b, "z", flags); e != syscall.EINVAL {
+			t.Errorf("Rename with flags %#x: got %v, want %v", flags, e, syscall.EINVAL)
+		}
+	}
+}
+
+// openFlags opens node with the given flags, and returns the handle and the
+// FUSE open flags of the response.
+func openFlags(t *testing.T, ctx context.Context, node *ffuse.FS, flags uint32) (fs.FileHandle, uint32) {
+	t.Helper()
+	fh, oflags, e := node.Open(ctx, flags)
+	if e != 0 {
+		t.Fatalf("Open %#x: %v", flags, e)
+	}
+	t.Cleanup(func() { fh.(fs.FileReleaser).Release(ctx) })
+	return fh, oflags
+}
+
+func TestOpenKeepCache(t *testing.T) {
+	root, ctx := newTestFS(t)
+	node := createFile(t, ctx, root, "f", "hello, world")
+
+	// The contents changed after the file was created, so the first open does
+	// not keep the cache, but a later open of the same contents does.
+	for i, want := range []uint32{0, fuse.FOPEN_KEEP_CACHE, fuse.FOPEN_KEEP_CACHE} {
+		if _, got := openFlags(t, ctx, node, syscall.O_RDONLY); got != want {
+			t.Errorf("Open %d: got flags %#x, want %#x", i+1, got, want)
+		}
+	}
+
+	// Once the contents change, the cache is not kept, until they are stable.
+	fh, _ := openFlags(t, ctx, node, syscall.O_WRONLY)
+	if _, e := fh.(fs.FileWriter).Write(ctx, []byte("H"), 0); e != 0 {
+		t.Fatalf("Write: %v", e)
+	}
+	for i, want := range []uint32{0, fuse.FOPEN_KEEP_CACHE} {
+		if _, got := openFlags(t, ctx, node, syscall.O_RDONLY); got != want {
+			t.Errorf("Open %d after write: got flags %#x, want %#x", i+1, got, want)
+		}
+	}
+
+	// Directories are not cached this way.
+	dir := makeDir(t, ctx, root, "d")
+	for i := range 2 {
+		if _, got := openFlags(t, ctx, dir, syscall.O_RDONLY); got != 0 {
+			t.Errorf("Open directory %d: got flags %#x, want 0", i+1, got)
+		}
+	}
+}
+
+func TestOpenFlags(t *testing.T) {
+	root, ctx := newTestFS(t)
+	node := createFile(t, ctx, root, "f", "hello, world")
+
+	// A handle open only for reading cannot be written.
+	fh, _ := openFlags(t, ctx, node, syscall.O_RDONLY)
+	if _, e := fh.(fs.FileWriter).Write(ctx, []byte("x"), 0); e != syscall.EBADF {
+		t.Errorf("Write to a read-only handle: got %v, want %v", e, syscall.EBADF)
+	}
+	if got := readFile(t, ctx, node); got != "hello, world" {
+		t.Errorf("After failed write: got %q, want unchanged", got)
+	}
+
+	// O_TRUNC discards the contents of the file.
+	openFlags(t, ctx, node, syscall.O_WRONLY|syscall.O_TRUNC)
+	if got := getAttr(t, ctx, node).Size; got != 0 {
+		t.Errorf("Size after O_TRUNC: got %d, want 0", got)
+	}
+}
+
+// createFile creates a file with the given name and contents in dir, and
+// returns its node.
+func createFile(t *testing.T, ctx context.Context, dir *ffuse.FS, name, data string) *ffuse.FS {
+	t.Helper()
+	in, fh, _, e := dir.Create(ctx, name, syscall.O_CREAT|syscall.O_EXCL|syscall.O_RDWR, 0644, new(fuse.EntryOut))
+	if e != 0 {
+		t.Fatalf("Create %q: %v", name, e)
+	}
+	if data != "" {
+		if _, e := fh.(fs.FileWriter).Write(ctx, []byte(data), 0); e != 0 {
+			t.Fatalf("Write %q: %v", name, e)
+		}
+	}
+	fh.(fs.FileReleaser).Release(ctx)
+	return in.Operations().(*ffuse.FS)
+}
+
+// makeDir creates a directory with the given name in dir, and returns its node.
+func makeDir(t *testing.T, ctx context.Context, dir *ffuse.FS, name string) *ffuse.FS {
+	t.Helper()
+	in, e := dir.Mkdir(ctx, name, 0755, new(fuse.EntryOut))
+	if e != 0 {
+		t.Fatalf("Mkdir %q: %v", name, e)
+	}
+	return in.Operations().(*ffuse.FS)
+}
+
+// getXAttr returns the value of the extended attribute attr of node.
+func getXAttr(t *testing.T, ctx context.Context, node *ffuse.FS, attr string) string {
+	t.Helper()
+	buf := make([]byte, 1<<16)
+	n, e := node.Getxattr(ctx, attr, buf)
+	if e != 0 {
+		t.Fatalf("Getxattr %q: %v", attr, e)
+	}
+	return string(buf[:n])
+}
+
+// remount flushes the tree served by root, and returns the root of a new FS
+// serving a copy of the tree loaded from st, with the given options.
+func remount(t *testing.T, ctx context.Context, root *ffuse.FS, st filetree.Store, opts *ffuse.Options) *ffuse.FS {
+	t.Helper()
+	key := getXAttr(t, ctx, root, "ffs.storageKey")
+	rf, err := file.Open(ctx, st.Files(), key)
+	if err != nil {
+		t.Fatalf("Open root: %v", err)
+	}
+	if opts == nil {
+		opts = new(ffuse.Options)
+	}
+	opts.Store = st
+	fsys := ffuse.New(rf, opts)
+	fs.NewNodeFS(fsys, &fs.Options{})
+	return fsys
+}
+
+// readDir lists all the entries of dir with a directory stream.
+func readDir(t *testing.T, ctx context.Context, dir *ffuse.FS) []fuse.DirEntry {
+	t.Helper()
+	fh, _, e := dir.OpendirHandle(ctx, 0)
+	if e != 0 {
+		t.Fatalf("OpendirHandle: %v", e)
+	}
+	defer fh.(fs.FileReleasedirer).Releasedir(ctx, 0)
+	var out []fuse.DirEntry
+	for {
+		ent, e := fh.(fs.FileReaddirenter).Readdirent(ctx)
+		if e != 0 {
+			t.Fatalf("Readdirent: %v", e)
+		} else if ent == nil {
+			return out
+		}
+		out = append(out, *ent)
+	}
+}
+
+func TestMknodDevice(t *testing.T) {
+	opts := new(ffuse.Options)
+	root, ctx := newTestFSOptions(t, opts)
+
+	// Device numbers use the Linux encoding, with the low bits of the minor
+	// number below the major number and the high bits above it.
+	const major, minor = 4, 0x1234
+	const dev = minor&0xff | major<<8 | (minor&^0xff)<<12
+	in, e := root.Mknod(ctx, "tty", syscall.S_IFCHR|0620, dev, new(fuse.EntryOut))
+	if e != 0 {
+		t.Fatalf("Mknod: %v", e)
+	}
+	check := func(label string, node *ffuse.FS) {
+		t.Helper()
+		attr := getAttr(t, ctx, node)
+		if got := attr.Mode & syscall.S_IFMT; got != syscall.S_IFCHR {
+			t.Errorf("%s: Getattr type is %o, want %o", label, got, syscall.S_IFCHR)
+		}
+		if attr.Rdev != dev {
+			t.Errorf("%s: Getattr rdev is %#x, want %#x", label, attr.Rdev, dev)
+		}
+		var sx fuse.StatxOut
+		if e := node.Statx(ctx, nil, 0, 0, &sx); e != 0 {
+			t.Fatalf("%s: Statx: %v", label, e)
+		}
+		if got := uint32(sx.Mode) & syscall.S_IFMT; got != syscall.S_IFCHR {
+			t.Errorf("%s: Statx type is %o, want %o", label, got, syscall.S_IFCHR)
+		}
+		if sx.RdevMajor != major || sx.RdevMinor != minor {
+			t.Errorf("%s: Statx device is %d:%d, want %d:%d", label, sx.RdevMajor, sx.RdevMinor, major, minor)
+		}
+	}
+	check("New", in.Operations().(*ffuse.FS))
+
+	// The device number is stored with the file, and survives a reload.
+	check("Reloaded", lookup(t, ctx, remount(t, ctx, root, opts.Store, nil), "tty"))
+}
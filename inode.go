@@ -0,0 +1,297 @@
+// Copyright 2019 Michael J. Fromberger. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ffuse
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"maps"
+	"math/rand/v2"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/creachadair/ffs/file"
+	"github.com/hanwen/go-fuse/v2/fs"
+)
+
+// Inode numbers are stable across mounts. Each file has a persistent ID, from
+// which the inode number of its node is derived. The root of the tree has ID
+// 1. Any other file has an ID derived from the ID of its parent directory and
+// its name, unless a different ID is recorded for its name in the metadata of
+// the parent.
+//
+// IDs are recorded in the directory rather than in the file itself, so that
+// a copy of a file linked in by its storage key does not share the ID of the
+// original. Such a copy is a new file, and is recorded with a new random ID.
+// Renaming a file records its ID under the new name, so that it keeps its
+// inode number.
+//
+// A file that keeps its ID under a name other than the one its ID derives
+// from is also noted in the link registry of the tree (see below), so that a
+// new file at its former name gets a new random ID instead of the same one.
+//
+// Each record also notes the ID of the directory that holds it. A copy of a
+// directory linked elsewhere by its storage key has a new ID, so the records
+// it inherits no longer apply, and the files in the copy get IDs derived from
+// their new location.
+
+// validInode maps v into the range of inode numbers assigned by the driver.
+// Numbers from 2^63 up are reserved by the FUSE library for automatic
+// assignment, and 0 and 1 are reserved for the root.
+func validInode(v uint64) uint64 {
+	v &= 1<<63 - 1
+	if v < 2 {
+		v += 2
+	}
+	return v
+}
+
+// newInodeID returns a new random file ID.
+func newInodeID() uint64 { return validInode(rand.Uint64()) }
+
+// derivedID returns the ID of a file whose parent has ID dir, and whose name
+// in the parent is name, unless another ID is recorded for it.
+func derivedID(dir uint64, name string) uint64 {
+	h := fnv.New64a()
+	h.Write(binary.LittleEndian.AppendUint64(nil, dir))
+	h.Write([]byte(name))
+	return validInode(h.Sum64())
+}
+
+// childID returns the ID of the child name of the directory f.
+func (f *FS) childID(name string) uint64 {
+	rec := f.file().XAttr().Get(metaIDPrefix + name)
+	if id, dir, ok := strings.Cut(rec, " "); ok && dir == strconv.FormatUint(f.id, 10) {
+		if v, err := strconv.ParseUint(id, 10, 64); err == nil {
+			return validInode(v)
+		}
+	}
+	return derivedID(f.id, name)
+}
+
+// setChildID records id as the ID of the child name of the directory f. The
+// caller must hold the directory lock of f.
+func (f *FS) setChildID(name string, id uint64) {
+	if id == derivedID(f.id, name) {
+		f.clearChildID(name) // the default
+	} else {
+		f.file().XAttr().Set(metaIDPrefix+name, fmt.Sprintf("%d %d", id, f.id))
+	}
+}
+
+// moveChildID records id, the ID of a file moved from another name, as the ID
+// of the child name of the directory f, and notes the file in the link
+// registry if id is not the default for name. The caller must hold the
+// directory lock of f.
+func (f *FS) moveChildID(name string, id uint64) {
+	f.setChildID(name, id)
+	if id != derivedID(f.id, name) {
+		f.st.reserveID(id)
+	}
+}
+
+// clearChildID removes the record for the child name of the directory f, if
+// any. The caller must hold the directory lock of f.
+func (f *FS) clearChildID(name string) { f.file().XAttr().Remove(metaIDPrefix + name) }
+
+// assignChildID assigns an ID to the file newly linked as the child name of
+// the directory f. It gets the default ID for its name, unless that ID is in
+// use by another file. The caller must hold the directory lock of f.
+func (f *FS) assignChildID(name string) {
+	if id := derivedID(f.id, name); f.st.isLinked(id) {
+		f.setChildID(name, newInodeID())
+	} else {
+		f.clearChildID(name)
+	}
+}
+
+// inode returns the inode number of the node for the file with the given ID.
+// The trees served by a [Roots] share the space of inode numbers, so each
+// mixes a distinct salt into its numbers.
+func (s *fsState) inode(id uint64) uint64 {
+	if s.salt == 0 {
+		return id
+	} else if id == 1 {
+		return s.salt
+	}
+	return validInode((id ^ s.salt) * 0x9e3779b97f4a7c15)
+}
+
+// Link counts are recorded by ID in the metadata of the root of the tree, for
+// files that have had more than one name, and for files, including
+// directories, that were moved away from the name their ID derives from. Like
+// IDs, they are kept out of the files themselves. The record of a file is kept
+// until its last name is removed, since its names may not include the one
+// that would otherwise give a new file the same ID. The registry thus holds
+// at most one record for each file in the tree.
+//
+// Removing a directory by unlinking it with ffs.link does not visit the files
+// inside it, so any of those files that also have names outside the directory
+// keep a count that is too high, and the records of moved files inside it
+// are kept.
+
+// linkCount reports the number of names linked to the file with the given ID,
+// if it is not a directory.
+func (s *fsState) linkCount(id uint64) uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.linkCountLocked(id)
+}
+
+// linkCountLocked is as linkCount, but the caller must hold s.mu.
+func (s *fsState) linkCountLocked(id uint64) uint32 {
+	if s.nlinks == nil {
+		s.nlinks = make(map[uint64]uint32)
+		for line := range strings.Lines(s.root.XAttr().Get(metaLinks)) {
+			a, b, _ := strings.Cut(strings.TrimSpace(line), " ")
+			id, err1 := strconv.ParseUint(a, 10, 64)
+			n, err2 := strconv.ParseUint(b, 10, 32)
+			if err1 == nil && err2 == nil {
+				s.nlinks[id] = uint32(n)
+			}
+		}
+	}
+	if n, ok := s.nlinks[id]; ok {
+		return n
+	}
+	return 1
+}
+
+// isLinked reports whether a link count is recorded for the given ID.
+func (s *fsState) isLinked(id uint64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.linkCountLocked(id) // load the records
+	_, ok := s.nlinks[id]
+	return ok
+}
+
+// addLinks adds delta to the link count of kid, the file with the given ID.
+// A directory has only one name, so its count is only ever reduced, when the
+// directory is removed.
+func (s *fsState) addLinks(id uint64, kid *file.File, delta int) {
+	touchChange(kid)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := max(int(s.linkCountLocked(id))+delta, 0)
+	if n < 2 {
+		delete(s.links, id)
+	}
+	if _, ok := s.nlinks[id]; !ok && n < 2 {
+		return // not recorded, and no need to be
+	} else if n == 0 {
+		delete(s.nlinks, id) // the last name is gone
+	} else {
+		s.nlinks[id] = uint32(n)
+	}
+	s.storeLinksLocked()
+}
+
+// reserveID records a link count for the file with the given ID, if it does
+// not have one, so that its ID is not given to another file.
+func (s *fsState) reserveID(id uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.linkCountLocked(id) // load the records
+	if _, ok := s.nlinks[id]; !ok {
+		s.nlinks[id] = 1
+		s.storeLinksLocked()
+	}
+}
+
+// storeLinksLocked writes the link counts to the metadata of the root.
+// The caller must hold s.mu.
+func (s *fsState) storeLinksLocked() {
+	if len(s.nlinks) == 0 {
+		s.root.XAttr().Remove(metaLinks)
+		return
+	}
+	var buf strings.Builder
+	for _, id := range slices.Sorted(maps.Keys(s.nlinks)) {
+		fmt.Fprintf(&buf, "%d %d\n", id, s.nlinks[id])
+	}
+	s.root.XAttr().Set(metaLinks, buf.String())
+}
+
+// newChild returns a node to serve nf as the child name of f. If nf is already
+// served by a live node, for example because it has another name, that node
+// is returned.
+//
+// Copies of a directory made outside the driver may carry records that give
+// two files the same ID. If the inode number of nf is already in use by a
+// node serving a different file, newChild assigns nf another number for the
+// lifetime of the node.
+func (f *FS) newChild(ctx context.Context, name string, nf *file.File) (*FS, *fs.Inode) {
+	id := f.childID(name)
+	t := f.st.nodes
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ino, n := t.find(f.st.inode(id), nf)
+	if n != nil {
+		return n, n.EmbeddedInode()
+	}
+	nfs := f.newFS(nf)
+	nfs.id = id
+	t.add(ino, nfs)
+	return nfs, f.NewInode(ctx, nfs, fs.StableAttr{
+		Mode: modeFileType(nf.Stat().Mode),
+		Ino:  ino,
+	})
+}
+
+// OnForget implements the [fs.NodeOnForgetter] interface.
+func (f *FS) OnForget() {
+	ino := f.StableAttr().Ino
+	t := f.st.nodes
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.nodes[ino] == f {
+		delete(t.nodes, ino)
+	}
+}
+
+// A nodeTable records the live nodes of one or more trees served by the same
+// FUSE mount, by inode number.
+type nodeTable struct {
+	mu    sync.Mutex
+	nodes map[uint64]*FS
+}
+
+// find returns the node serving nf, if its number is ino. Otherwise it returns
+// a number not in use for a new node serving nf, starting from ino. The
+// caller must hold t.mu.
+func (t *nodeTable) find(ino uint64, nf *file.File) (uint64, *FS) {
+	for {
+		n, ok := t.nodes[ino]
+		if !ok {
+			return ino, nil
+		} else if n.file() == nf {
+			return ino, n
+		}
+		ino = validInode(ino*0x9e3779b97f4a7c15 + 1)
+	}
+}
+
+// add records n as the node with number ino. The caller must hold t.mu.
+func (t *nodeTable) add(ino uint64, n *FS) {
+	if t.nodes == nil {
+		t.nodes = make(map[uint64]*FS)
+	}
+	t.nodes[ino] = n
+}
@@ -0,0 +1,185 @@
+// Copyright 2019 Michael J. Fromberger. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ffuse_test
+
+import (
+	"fmt"
+	"maps"
+	"strings"
+	"testing"
+
+	"github.com/creachadair/ffs/file"
+	"github.com/creachadair/ffuse"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestInodeRemount(t *testing.T) {
+	opts := new(ffuse.Options)
+	root, ctx := newTestFSOptions(t, opts)
+	d := makeDir(t, ctx, root, "d")
+	aino := createFile(t, ctx, d, "a", "apple").StableAttr().Ino
+	createFile(t, ctx, d, "x", "xylophone")
+	createFile(t, ctx, root, "b", "banana")
+
+	// Renames keep the number of the file, and of the files inside it.
+	if e := d.Rename(ctx, "a", root, "a2", 0); e != 0 {
+		t.Fatalf("Rename a: %v", e)
+	}
+	if e := root.Rename(ctx, "d", root, "d2", 0); e != 0 {
+		t.Fatalf("Rename d: %v", e)
+	}
+	if e := root.Rename(ctx, "b", root, "a2", renameExchange); e != 0 {
+		t.Fatalf("Exchange: %v", e)
+	}
+
+	// A copy linked from a storage key is a new file, with its own number.
+	key := getXAttr(t, ctx, root, "ffs.link.d2")
+	if e := root.Setxattr(ctx, "ffs.link.g", []byte(key), 0); e != 0 {
+		t.Fatalf("Setxattr ffs.link.g: %v", e)
+	}
+
+	paths := [][]string{{"a2"}, {"b"}, {"d2"}, {"d2", "x"}, {"g"}, {"g", "x"}}
+	inos := func(root *ffuse.FS) map[uint64]string {
+		t.Helper()
+		m := make(map[uint64]string)
+		for _, p := range paths {
+			n := root
+			for _, name := range p {
+				n = lookup(t, ctx, n, name)
+			}
+			ino := n.StableAttr().Ino
+			if q, ok := m[ino]; ok {
+				t.Errorf("Files %q and %q have the same inode number %d", q, p, ino)
+			}
+			m[ino] = strings.Join(p, "/")
+		}
+		return m
+	}
+	before := inos(root)
+	after := inos(remount(t, ctx, root, opts.Store, nil))
+	if !maps.Equal(after, before) {
+		t.Errorf("Inode numbers after remount:\n got %v\nwant %v", after, before)
+	}
+	if got := after[aino]; got != "b" {
+		t.Errorf("After remount, inode %d is %q, want b", aino, got)
+	}
+}
+
+func TestLinkCountRemount(t *testing.T) {
+	opts := new(ffuse.Options)
+	root, ctx := newTestFSOptions(t, opts)
+	a := createFile(t, ctx, root, "a", "apple")
+	d := makeDir(t, ctx, root, "d")
+	for _, link := range []struct {
+		dir  *ffuse.FS
+		name string
+	}{{root, "b"}, {d, "c"}} {
+		if _, e := link.dir.Link(ctx, a, link.name, new(fuse.EntryOut)); e != 0 {
+			t.Fatalf("Link %q: %v", link.name, e)
+		}
+	}
+	if e := root.Unlink(ctx, "b"); e != 0 {
+		t.Fatalf("Unlink b: %v", e)
+	}
+
+	// A copy of a directory linked from its storage key does not share the
+	// links of the files inside it, and the counts do not change their keys.
+	key := getXAttr(t, ctx, root, "ffs.link.d")
+	if e := root.Setxattr(ctx, "ffs.link.g", []byte(key), 0); e != 0 {
+		t.Fatalf("Setxattr ffs.link.g: %v", e)
+	}
+	g := lookup(t, ctx, root, "g")
+	if got, want := getXAttr(t, ctx, lookup(t, ctx, g, "c"), "ffs.storageKey"), getXAttr(t, ctx, a, "ffs.storageKey"); got != want {
+		t.Errorf("Storage key of g/c: got %x, want %x", got, want)
+	}
+
+	check := func(root *ffuse.FS) {
+		t.Helper()
+		a, d, g := lookup(t, ctx, root, "a"), lookup(t, ctx, root, "d"), lookup(t, ctx, root, "g")
+		c, gc := lookup(t, ctx, d, "c"), lookup(t, ctx, g, "c")
+		if got := getAttr(t, ctx, a).Nlink; got != 2 {
+			t.Errorf("Nlink of a: got %d, want 2", got)
+		}
+		if c != a {
+			t.Errorf("Names a and d/c have different nodes (inodes %d, %d)", a.StableAttr().Ino, c.StableAttr().Ino)
+		}
+		if got := getAttr(t, ctx, gc).Nlink; got != 1 {
+			t.Errorf("Nlink of g/c: got %d, want 1", got)
+		}
+		if gc == a {
+			t.Error("Names a and g/c have the same node")
+		}
+	}
+	check(root)
+	check(remount(t, ctx, root, opts.Store, nil))
+}
+
+func TestInodeRecords(t *testing.T) {
+	opts := new(ffuse.Options)
+	root, ctx := newTestFSOptions(t, opts)
+	d := makeDir(t, ctx, root, "d")
+	createFile(t, ctx, d, "target", "v0")
+
+	// Saving a file as many editors do, by writing a temporary file and
+	// renaming it over the target, leaves no records for the old names.
+	for i := range 50 {
+		tmp := fmt.Sprintf(".target.%d", i)
+		createFile(t, ctx, d, tmp, fmt.Sprint("v", i+1))
+		if e := d.Rename(ctx, tmp, d, "target", 0); e != 0 {
+			t.Fatalf("Rename %q: %v", tmp, e)
+		}
+	}
+	rf, err := file.Open(ctx, opts.Store.Files(), getXAttr(t, ctx, root, "ffs.storageKey"))
+	if err != nil {
+		t.Fatalf("Open root: %v", err)
+	}
+	df, err := rf.Open(ctx, "d")
+	if err != nil {
+		t.Fatalf("Open d: %v", err)
+	}
+	var recs []string
+	for _, name := range df.XAttr().Names() {
+		if strings.HasPrefix(name, "ffuse.ino/") {
+			recs = append(recs, name)
+		}
+	}
+	if len(recs) > 1 {
+		t.Errorf("Directory records: got %q, want at most one", recs)
+	}
+	if got := strings.Count(rf.XAttr().Get("ffuse.links"), "\n"); got > 1 {
+		t.Errorf("Link registry: got %d records, want at most one", got)
+	}
+
+	// A new file at the former name of a moved file gets its own number, and
+	// keeps it after a remount, while the moved file exists.
+	ino := func(root *ffuse.FS, names ...string) uint64 {
+		t.Helper()
+		n := root
+		for _, name := range names {
+			n = lookup(t, ctx, n, name)
+		}
+		return n.StableAttr().Ino
+	}
+	createFile(t, ctx, d, "a", "apple")
+	if e := d.Rename(ctx, "a", root, "b", 0); e != 0 {
+		t.Fatalf("Rename a: %v", e)
+	}
+	createFile(t, ctx, d, "a", "avocado")
+	for _, r := range []*ffuse.FS{root, remount(t, ctx, root, opts.Store, nil)} {
+		if da, b := ino(r, "d", "a"), ino(r, "b"); da == b {
+			t.Errorf("Files d/a and b have the same inode number %d", da)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+// Copyright 2019 Michael J. Fromberger. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ffuse
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"syscall"
+
+	"github.com/creachadair/ffs/file"
+	"github.com/creachadair/ffs/file/root"
+	"github.com/creachadair/ffs/fpath"
+)
+
+// setLink links the file with the given storage key as the child name of the
+// directory f, replacing any existing child with that name. The flags are as
+// for setxattr(2), and apply to the child.
+func (f *FS) setLink(ctx context.Context, name, key string, flags uint32) errno {
+	if !f.file().Stat().Mode.IsDir() {
+		return syscall.EPERM // only allow linking in a directory
+	} else if name == "" || strings.ContainsAny(name, "/\x00") {
+		return syscall.EINVAL // disallow empty names, directory separators, NUL
+	} else if f.isControlName(name) {
+		return syscall.EPERM
+	}
+	f.st.nsMu.Lock()
+	defer f.st.nsMu.Unlock()
+	defer lockDirs(f, f.liveChild(name))()
+	old, err := f.openChild(ctx, name)
+	exists := err == nil
+	if err != nil && !errors.Is(err, file.ErrChildNotFound) {
+		return errorToErrno(err)
+	} else if exists && flags&xattrCreate != 0 {
+		return syscall.EEXIST
+	} else if !exists && flags&xattrReplace != 0 {
+		return xattrErrnoNotFound
+	} else if exists {
+		if e := f.checkRemoveEntry(ctx, old); e != noError {
+			return e
+		}
+	} else if e := f.checkAddEntry(ctx); e != noError {
+		return e
+	}
+
+	tf, err := f.file().Load(ctx, key)
+	if err != nil {
+		return syscall.ENOENT
+	}
+
+	// The loaded file is a new copy, and this is its only name.
+	f.addEntry(name, tf, old) // old is nil if it does not exist
+	f.setChildID(name, newInodeID())
+	go f.NotifyEntry(name) // outside the lock
+	return noError
+}
+
+// rootFileKey returns the storage key of the file named by spec, which is the
+// name of a root pointer in the store, optionally followed by a colon and a
+// slash-separated path from the root file. The directory f is the intended
+// parent of the file.
+func (f *FS) rootFileKey(ctx context.Context, spec string) (string, errno) {
+	if !f.file().Stat().Mode.IsDir() {
+		return "", syscall.EPERM // only allow linking in a directory
+	} else if !f.st.opts.Store.IsValid() {
+		return "", syscall.ENOTSUP // no store to resolve roots
+	}
+	name, path, _ := strings.Cut(spec, ":")
+	rp, err := root.Open(ctx, f.st.opts.Store.Roots(), name)
+	if err != nil {
+		return "", errorToErrno(err)
+	}
+	rf, err := rp.File(ctx, f.st.opts.Store.Files())
+	if errors.Is(err, root.ErrNoData) {
+		return "", syscall.ENOENT
+	} else if err != nil {
+		return "", errorToErrno(err)
+	}
+	tf, err := fpath.Open(ctx, rf, path)
+	if err != nil {
+		return "", errorToErrno(err)
+	}
+	key, err := tf.Flush(ctx)
+	if err != nil {
+		return "", errorToErrno(err)
+	}
+	return key, noError
+}
+
+// ffsLinks is a write-only attribute of a directory that applies a batch of
+// edits to its entries. Each line of the value is one edit, consisting of a
+// storage key in hex, as reported by the ffs.link.<name>.hex attribute, a
+// space, and a name:
+//
+//	0123abcd... name
+//
+// links the file with that storage key as the child name, replacing any
+// existing child with that name. If the key is "-", the existing child is
+// unlinked instead. Empty lines are ignored, and each name may be edited only
+// once in a batch.
+//
+// The edits are checked before any is applied, and are applied while holding
+// the lock of the directory, so other operations see either none or all of
+// them. The new children are loaded from storage before the lock is taken.
+const ffsLinks = "ffs.links"
+
+// A linkEdit is a single edit parsed from the value of ffsLinks.
+type linkEdit struct {
+	name string
+	key  string // storage key of the new child, or "" to unlink
+
+	tf, old *file.File // the new and old children, if any
+}
+
+// parseLinkEdits parses the value of ffsLinks.
+func parseLinkEdits(data []byte) ([]linkEdit, error) {
+	var edits []linkEdit
+	seen := make(map[string]bool)
+	for line := range strings.Lines(string(data)) {
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			continue
+		}
+		tag, name, ok := strings.Cut(line, " ")
+		if !ok || name == "" || strings.ContainsAny(name, "/\x00") {
+			return nil, errors.New("invalid link edit")
+		} else if seen[name] {
+			return nil, errors.New("duplicate link edit")
+		}
+		seen[name] = true
+		e := linkEdit{name: name}
+		if tag != "-" {
+			key, err := hex.DecodeString(tag)
+			if err != nil || len(key) == 0 {
+				return nil, errors.New("invalid storage key")
+			}
+			e.key = string(key)
+		}
+		edits = append(edits, e)
+	}
+	return edits, nil
+}
+
+// openEntry returns the child name of the directory f, or nil if there is no
+// such child.
+func (f *FS) openEntry(ctx context.Context, name string) (*file.File, errno) {
+	kid, err := f.openChild(ctx, name)
+	if errors.Is(err, file.ErrChildNotFound) {
+		return nil, noError
+	} else if err != nil {
+		return nil, errorToErrno(err)
+	}
+	return kid, noError
+}
+
+// checkLinkEdit checks that the caller may apply e to the directory f, whose
+// child e.name is old, or nil if there is no such child.
+func (f *FS) checkLinkEdit(ctx context.Context, e linkEdit, old *file.File) errno {
+	if old != nil {
+		return f.checkRemoveEntry(ctx, old)
+	} else if e.key == "" {
+		return xattrErrnoNotFound // nothing to unlink
+	}
+	return f.checkAddEntry(ctx)
+}
+
+// setLinks applies the batch of link edits in data to the directory f.
+func (f *FS) setLinks(ctx context.Context, data []byte) errno {
+	if !f.file().Stat().Mode.IsDir() {
+		return syscall.EPERM // only allow linking in a directory
+	}
+	edits, err := parseLinkEdits(data)
+	if err != nil {
+		return syscall.EINVAL
+	}
+
+	// Load the new children, and check all the edits, before taking the
+	// locks, so that storage is not read while holding them.
+	for i, e := range edits {
+		if f.isControlName(e.name) {
+			return syscall.EPERM
+		}
+		if e.key != "" {
+			tf, err := f.file().Load(ctx, e.key)
+			if err != nil {
+				return syscall.ENOENT
+			}
+			edits[i].tf = tf
+		}
+		old, errno := f.openEntry(ctx, e.name)
+		if errno != noError {
+			return errno
+		} else if errno := f.checkLinkEdit(ctx, e, old); errno != noError {
+			return errno
+		}
+		edits[i].old = old
+	}
+
+	f.st.nsMu.Lock()
+	defer f.st.nsMu.Unlock()
+	dirs := []*FS{f}
+	for _, e := range edits {
+		dirs = append(dirs, f.liveChild(e.name))
+	}
+	defer lockDirs(dirs...)()
+
+	// Check again any entry that changed before the locks were taken.
+	for i, e := range edits {
+		old, errno := f.openEntry(ctx, e.name)
+		if errno != noError {
+			return errno
+		} else if old == e.old {
+			continue
+		} else if errno := f.checkLinkEdit(ctx, e, old); errno != noError {
+			return errno
+		}
+		edits[i].old = old
+	}
+
+	for _, e := range edits {
+		if e.tf != nil {
+			f.addEntry(e.name, e.tf, e.old)
+			f.setChildID(e.name, newInodeID()) // a new copy
+		} else {
+			f.removeEntry(e.name, e.old)
+		}
+	}
+	go func() { // outside the lock
+		for _, e := range edits {
+			f.NotifyEntry(e.name)
+		}
+	}()
+	return noError
+}
@@ -0,0 +1,201 @@
+// Copyright 2019 Michael J. Fromberger. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ffuse
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// A lockTable records the advisory locks held on a single file.  Locks are
+// held only in memory, and are shared by all the handles open on the node
+// that owns the table.
+//
+// POSIX (fcntl) locks are byte ranges owned by a lock owner, and a new lock
+// replaces any overlapping locks of the same owner. BSD (flock) locks cover
+// the whole file and are owned by an open file. As on Linux, the two kinds of
+// lock do not interact with each other.
+type lockTable struct {
+	mu    sync.Mutex
+	locks []fileLock
+	wait  chan struct{} // closed when any lock is released, or nil
+}
+
+// A fileLock is a single lock held in a lockTable.
+type fileLock struct {
+	owner      uint64
+	h          *fileHandle // the handle through which the lock was acquired
+	flock      bool        // whether this is a BSD lock
+	start, end uint64      // inclusive
+	typ        uint32      // F_RDLCK or F_WRLCK
+	pid        uint32
+}
+
+func (l fileLock) overlaps(start, end uint64) bool { return l.start <= end && start <= l.end }
+
+// conflictLocked reports the first lock in t that conflicts with a request of
+// type typ on the given range by owner, if any.
+func (t *lockTable) conflictLocked(owner uint64, flock bool, start, end uint64, typ uint32) (fileLock, bool) {
+	for _, l := range t.locks {
+		if l.flock != flock || l.owner == owner || !l.overlaps(start, end) {
+			continue
+		}
+		if l.typ == syscall.F_WRLCK || typ == syscall.F_WRLCK {
+			return l, true
+		}
+	}
+	return fileLock{}, false
+}
+
+// removeLocked removes the locks of the given kind held by owner on the range,
+// splitting any locks that extend beyond it. It reports whether any locks
+// were removed.
+func (t *lockTable) removeLocked(owner uint64, flock bool, start, end uint64) bool {
+	var changed bool
+	var keep []fileLock
+	for _, l := range t.locks {
+		if l.flock != flock || l.owner != owner || !l.overlaps(start, end) {
+			keep = append(keep, l)
+			continue
+		}
+		changed = true
+		if l.start < start {
+			left := l
+			left.end = start - 1
+			keep = append(keep, left)
+		}
+		if l.end > end {
+			right := l
+			right.start = end + 1
+			keep = append(keep, right)
+		}
+	}
+	t.locks = keep
+	return changed
+}
+
+// wakeLocked wakes any goroutines waiting for locks to be released.
+func (t *lockTable) wakeLocked() {
+	if t.wait != nil {
+		close(t.wait)
+		t.wait = nil
+	}
+}
+
+// get reports a lock that would conflict with lk, or F_UNLCK if none.
+func (t *lockTable) get(owner uint64, lk *fuse.FileLock, flags uint32, out *fuse.FileLock) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	c, ok := t.conflictLocked(owner, flags&fuse.FUSE_LK_FLOCK != 0, lk.Start, lk.End, lk.Typ)
+	if !ok {
+		*out = *lk
+		out.Typ = syscall.F_UNLCK
+		return
+	}
+	*out = fuse.FileLock{Start: c.start, End: c.end, Typ: c.typ, Pid: c.pid}
+}
+
+// set acquires or releases lk for owner via h. If wait is true, set blocks
+// until the lock can be acquired or ctx ends; otherwise it reports EAGAIN if
+// the lock is not available.
+func (t *lockTable) set(ctx context.Context, h *fileHandle, owner uint64, lk *fuse.FileLock, flags uint32, wait bool) errno {
+	flock := flags&fuse.FUSE_LK_FLOCK != 0
+	start, end := lk.Start, lk.End
+	if flock {
+		start, end = 0, ^uint64(0) // whole file
+	}
+
+	switch lk.Typ {
+	case syscall.F_UNLCK:
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if t.removeLocked(owner, flock, start, end) {
+			t.wakeLocked()
+		}
+		return noError
+	case syscall.F_RDLCK, syscall.F_WRLCK:
+		// OK
+	default:
+		return syscall.EINVAL
+	}
+
+	for {
+		t.mu.Lock()
+		if _, ok := t.conflictLocked(owner, flock, start, end, lk.Typ); !ok {
+			// Replacing an existing lock may downgrade it, which can unblock
+			// other waiters.
+			if t.removeLocked(owner, flock, start, end) {
+				t.wakeLocked()
+			}
+			t.locks = append(t.locks, fileLock{
+				owner: owner,
+				h:     h,
+				flock: flock,
+				start: start,
+				end:   end,
+				typ:   lk.Typ,
+				pid:   lk.Pid,
+			})
+			t.mu.Unlock()
+			return noError
+		} else if !wait {
+			t.mu.Unlock()
+			return syscall.EAGAIN
+		}
+		if t.wait == nil {
+			t.wait = make(chan struct{})
+		}
+		ready := t.wait
+		t.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return syscall.EINTR
+		case <-ready:
+			// try again
+		}
+	}
+}
+
+// release discards all the locks acquired via h.
+func (t *lockTable) release(h *fileHandle) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := len(t.locks)
+	t.locks = slices.DeleteFunc(t.locks, func(l fileLock) bool { return l.h == h })
+	if len(t.locks) != n {
+		t.wakeLocked()
+	}
+}
+
+// Getlk implements the [fs.FileGetlker] interface.
+func (h *fileHandle) Getlk(ctx context.Context, owner uint64, lk *fuse.FileLock, flags uint32, out *fuse.FileLock) errno {
+	h.fs.locks.get(owner, lk, flags, out)
+	return noError
+}
+
+// Setlk implements the [fs.FileSetlker] interface.
+func (h *fileHandle) Setlk(ctx context.Context, owner uint64, lk *fuse.FileLock, flags uint32) errno {
+	return h.fs.locks.set(ctx, h, owner, lk, flags, false)
+}
+
+// Setlkw implements the [fs.FileSetlkwer] interface.
+func (h *fileHandle) Setlkw(ctx context.Context, owner uint64, lk *fuse.FileLock, flags uint32) errno {
+	return h.fs.locks.set(ctx, h, owner, lk, flags, true)
+}
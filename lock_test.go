@@ -0,0 +1,157 @@
+// Copyright 2019 Michael J. Fromberger. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ffuse_test
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// A locker is a file handle that supports advisory locks.
+type locker interface {
+	fs.FileGetlker
+	fs.FileSetlker
+	fs.FileSetlkwer
+}
+
+func TestLocks(t *testing.T) {
+	root, ctx := newTestFS(t)
+	node := createFile(t, ctx, root, "f", "hello, world")
+	h1 := openFile(t, ctx, node, syscall.O_RDWR).(locker)
+	h2 := openFile(t, ctx, node, syscall.O_RDWR).(locker)
+
+	lock := func(typ uint32, start, end uint64) *fuse.FileLock {
+		return &fuse.FileLock{Start: start, End: end, Typ: typ, Pid: 1}
+	}
+	for _, flags := range []uint32{0, fuse.FUSE_LK_FLOCK} {
+		// Shared locks held by different owners do not conflict.
+		if e := h1.Setlk(ctx, 1, lock(syscall.F_RDLCK, 0, 99), flags); e != 0 {
+			t.Fatalf("Setlk(1, RDLCK) flags %#x: %v", flags, e)
+		}
+		if e := h2.Setlk(ctx, 2, lock(syscall.F_RDLCK, 50, 149), flags); e != 0 {
+			t.Fatalf("Setlk(2, RDLCK) flags %#x: %v", flags, e)
+		}
+
+		// An exclusive lock conflicts with a shared lock of another owner.
+		if e := h2.Setlk(ctx, 2, lock(syscall.F_WRLCK, 0, 9), flags); e != syscall.EAGAIN {
+			t.Errorf("Setlk(2, WRLCK) flags %#x: got %v, want %v", flags, e, syscall.EAGAIN)
+		}
+		var out fuse.FileLock
+		if e := h2.Getlk(ctx, 2, lock(syscall.F_WRLCK, 0, 9), flags, &out); e != 0 {
+			t.Fatalf("Getlk flags %#x: %v", flags, e)
+		} else if out.Typ != syscall.F_RDLCK || out.Pid != 1 {
+			t.Errorf("Getlk flags %#x: got %+v, want a read lock held by pid 1", flags, out)
+		}
+
+		// Once the other owner unlocks, the exclusive lock succeeds, and
+		// conflicts with any other lock.
+		if e := h1.Setlk(ctx, 1, lock(syscall.F_UNLCK, 0, 99), flags); e != 0 {
+			t.Fatalf("Setlk(1, UNLCK) flags %#x: %v", flags, e)
+		}
+		if e := h2.Setlk(ctx, 2, lock(syscall.F_WRLCK, 0, 9), flags); e != 0 {
+			t.Fatalf("Setlk(2, WRLCK) flags %#x: %v", flags, e)
+		}
+		if e := h1.Setlk(ctx, 1, lock(syscall.F_RDLCK, 0, 9), flags); e != syscall.EAGAIN {
+			t.Errorf("Setlk(1, RDLCK) flags %#x: got %v, want %v", flags, e, syscall.EAGAIN)
+		}
+		if e := h2.Setlk(ctx, 2, lock(syscall.F_UNLCK, 0, ^uint64(0)), flags); e != 0 {
+			t.Fatalf("Setlk(2, UNLCK) flags %#x: %v", flags, e)
+		}
+	}
+
+	// POSIX locks on disjoint ranges do not conflict.
+	if e := h1.Setlk(ctx, 1, lock(syscall.F_WRLCK, 0, 9), 0); e != 0 {
+		t.Fatalf("Setlk(1, WRLCK): %v", e)
+	}
+	if e := h2.Setlk(ctx, 2, lock(syscall.F_WRLCK, 10, 19), 0); e != 0 {
+		t.Errorf("Setlk(2, WRLCK) on a disjoint range: %v", e)
+	}
+}
+
+func TestLockWait(t *testing.T) {
+	root, ctx := newTestFS(t)
+	node := createFile(t, ctx, root, "f", "hello, world")
+	h1 := openFile(t, ctx, node, syscall.O_RDWR).(locker)
+	h2 := openFile(t, ctx, node, syscall.O_RDWR).(locker)
+
+	wrlock := &fuse.FileLock{End: 99, Typ: syscall.F_WRLCK}
+	if e := h1.Setlk(ctx, 1, wrlock, 0); e != 0 {
+		t.Fatalf("Setlk(1): %v", e)
+	}
+
+	// A blocked wait ends with EINTR when its context is cancelled.
+	wctx, cancel := context.WithCancel(ctx)
+	done := make(chan syscall.Errno)
+	go func() { done <- h2.Setlkw(wctx, 2, wrlock, 0) }()
+	select {
+	case e := <-done:
+		t.Fatalf("Setlkw(2) did not block: %v", e)
+	case <-time.After(50 * time.Millisecond):
+	}
+	cancel()
+	if e := <-done; e != syscall.EINTR {
+		t.Errorf("Setlkw(2) after cancel: got %v, want %v", e, syscall.EINTR)
+	}
+
+	// A blocked wait succeeds once the conflicting lock is released.
+	go func() { done <- h2.Setlkw(ctx, 2, wrlock, 0) }()
+	time.Sleep(10 * time.Millisecond)
+	if e := h1.Setlk(ctx, 1, &fuse.FileLock{End: 99, Typ: syscall.F_UNLCK}, 0); e != 0 {
+		t.Fatalf("Setlk(1, UNLCK): %v", e)
+	}
+	select {
+	case e := <-done:
+		if e != 0 {
+			t.Errorf("Setlkw(2) after unlock: %v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Setlkw(2) did not acquire the lock after unlock")
+	}
+}
+
+func TestLockRelease(t *testing.T) {
+	root, ctx := newTestFS(t)
+	node := createFile(t, ctx, root, "f", "hello, world")
+	fh, _, e := node.Open(ctx, syscall.O_RDWR)
+	if e != 0 {
+		t.Fatalf("Open: %v", e)
+	}
+	h1 := fh.(locker)
+	h2 := openFile(t, ctx, node, syscall.O_RDWR).(locker)
+
+	wrlock := &fuse.FileLock{End: 99, Typ: syscall.F_WRLCK}
+	if e := h1.Setlk(ctx, 1, wrlock, 0); e != 0 {
+		t.Fatalf("Setlk(1, POSIX): %v", e)
+	}
+	if e := h1.Setlk(ctx, 1, wrlock, fuse.FUSE_LK_FLOCK); e != 0 {
+		t.Fatalf("Setlk(1, flock): %v", e)
+	}
+	if e := h2.Setlk(ctx, 2, wrlock, 0); e != syscall.EAGAIN {
+		t.Errorf("Setlk(2) while held: got %v, want %v", e, syscall.EAGAIN)
+	}
+
+	// Releasing the handle drops all the locks acquired through it.
+	fh.(fs.FileReleaser).Release(ctx)
+	for _, flags := range []uint32{0, fuse.FUSE_LK_FLOCK} {
+		if e := h2.Setlk(ctx, 2, wrlock, flags); e != 0 {
+			t.Errorf("Setlk(2) flags %#x after release: %v", flags, e)
+		}
+	}
+}
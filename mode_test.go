@@ -0,0 +1,89 @@
+// Copyright 2019 Michael J. Fromberger. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ffuse
+
+import (
+	"os"
+	"syscall"
+	"testing"
+)
+
+var fileTypes = []struct {
+	mode os.FileMode
+	sys  uint32
+}{
+	{0, syscall.S_IFREG},
+	{os.ModeDir, syscall.S_IFDIR},
+	{os.ModeSymlink, syscall.S_IFLNK},
+	{os.ModeSocket, syscall.S_IFSOCK},
+	{os.ModeNamedPipe, syscall.S_IFIFO},
+	{os.ModeDevice | os.ModeCharDevice, syscall.S_IFCHR},
+	{os.ModeDevice, syscall.S_IFBLK},
+}
+
+func TestModeRoundTrip(t *testing.T) {
+	special := []struct {
+		mode os.FileMode
+		sys  uint32
+	}{
+		{os.ModeSetuid, syscall.S_ISUID},
+		{os.ModeSetgid, syscall.S_ISGID},
+		{os.ModeSticky, syscall.S_ISVTX},
+	}
+	for _, ft := range fileTypes {
+		for perm := os.FileMode(0); perm <= 0777; perm++ {
+			for bits := range 1 << len(special) {
+				mode, sys := ft.mode|perm, ft.sys|uint32(perm)
+				for i, sp := range special {
+					if bits&(1<<i) != 0 {
+						mode |= sp.mode
+						sys |= sp.sys
+					}
+				}
+				if got := toSysMode(mode); got != sys {
+					t.Fatalf("toSysMode(%v): got %#o, want %#o", mode, got, sys)
+				}
+				if got := fromSysMode(sys, true); got != mode {
+					t.Fatalf("fromSysMode(%#o, true): got %v, want %v", sys, got, mode)
+				}
+				if got, want := fromSysMode(sys, false), mode&^os.ModeType; got != want {
+					t.Fatalf("fromSysMode(%#o, false): got %v, want %v", sys, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestFromSysModeType(t *testing.T) {
+	// A mode with no type bits is treated as a regular file.
+	if got := fromSysMode(0644, true); got != 0644 {
+		t.Errorf("fromSysMode(0644, true): got %v, want %v", got, os.FileMode(0644))
+	}
+
+	// Every possible value of the type field that is not a known file type
+	// decodes as irregular.
+	known := make(map[uint32]bool)
+	for _, ft := range fileTypes {
+		known[ft.sys] = true
+	}
+	for typ := uint32(0); typ <= syscall.S_IFMT; typ += 1 << 12 {
+		if typ == 0 || known[typ] {
+			continue
+		}
+		if got := fromSysMode(typ|0755, true); got != os.ModeIrregular|0755 {
+			t.Errorf("fromSysMode(%#o, true): got %v, want irregular", typ|0755, got)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+// Copyright 2019 Michael J. Fromberger. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ffuse_test
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestOpenDirect(t *testing.T) {
+	root, ctx := newTestFS(t)
+	node := createFile(t, ctx, root, "f", "hello, world")
+
+	// Direct I/O bypasses the page cache, even when the contents have not
+	// changed since the last open.
+	openFlags(t, ctx, node, syscall.O_RDONLY)
+	if _, got := openFlags(t, ctx, node, syscall.O_RDONLY|syscall.O_DIRECT); got != fuse.FOPEN_DIRECT_IO {
+		t.Errorf("Open O_DIRECT: got flags %#x, want %#x", got, fuse.FOPEN_DIRECT_IO)
+	}
+}
+
+func TestOpenNoAtime(t *testing.T) {
+	root, ctx := newStrictFS(t, 0777)
+	node := createFile(t, ctx, root, "f", "hello, world")
+
+	// Only the owner of a file may open it with O_NOATIME.
+	openFlags(t, ctx, node, syscall.O_RDONLY|syscall.O_NOATIME)
+	if _, _, e := node.Open(asUser(ctx, 2000, 2000), syscall.O_RDONLY|syscall.O_NOATIME); e != syscall.EPERM {
+		t.Errorf("Open O_NOATIME by another user: got %v, want %v", e, syscall.EPERM)
+	}
+}
@@ -0,0 +1,246 @@
+// Copyright 2019 Michael J. Fromberger. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ffuse
+
+import (
+	"context"
+	"os"
+	"slices"
+	"strings"
+	"syscall"
+
+	"github.com/creachadair/ffs/file"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// Permission bits for access checks, as for access(2).
+const (
+	permExec  = 1 // X_OK
+	permWrite = 2 // W_OK
+	permRead  = 4 // R_OK
+)
+
+// mayAccess reports whether c is permitted the access in mask to a file with
+// the given stat, according to the usual Unix rules.
+func mayAccess(c *fuse.Caller, s file.Stat, mask uint32) bool {
+	if c.Uid == 0 {
+		// Root may read and write anything, search any directory, and execute
+		// any file that has at least one execute bit set.
+		return mask&permExec == 0 || s.Mode.IsDir() || s.Mode.Perm()&0111 != 0
+	}
+	bits := uint32(s.Mode.Perm())
+	if s.OwnerID == int(c.Uid) {
+		bits >>= 6 // use owner bits
+	} else if inGroup(c, s.GroupID) {
+		bits >>= 3 // use group bits
+	} // default to world bits
+	return mask&bits&7 == mask
+}
+
+// inGroup reports whether gid is the primary or a supplementary group of c.
+func inGroup(c *fuse.Caller, gid int) bool {
+	return int(c.Gid) == gid || slices.Contains(callerGroups(c.Pid), uint32(gid))
+}
+
+// openMask returns the access required to open a file with the given flags.
+func openMask(flags uint32) uint32 {
+	var mask uint32
+	switch flags & syscall.O_ACCMODE {
+	case syscall.O_RDONLY:
+		mask = permRead
+	case syscall.O_WRONLY:
+		mask = permWrite
+	default:
+		mask = permRead | permWrite
+	}
+	if flags&syscall.O_TRUNC != 0 {
+		mask |= permWrite
+	}
+	return mask
+}
+
+// checkWritable checks that the tree accepts changes, and if so records that
+// a change is about to be made.
+func (s *fsState) checkWritable() errno {
+	if s.readOnly.Load() {
+		return syscall.EROFS
+	}
+	s.noteChange()
+	return noError
+}
+
+// The methods below enforce permissions only if the StrictPermissions option
+// is enabled, and otherwise permit everything. The methods that check changes
+// to the tree also refuse them if the tree is read-only.
+
+// checkAccess checks that the caller is permitted the access in mask to f.
+func (f *FS) checkAccess(ctx context.Context, mask uint32) errno {
+	if !f.st.opts.StrictPermissions {
+		return noError
+	}
+	caller, ok := fuse.FromContext(ctx)
+	if !ok {
+		return syscall.ENOSYS
+	}
+	if !mayAccess(caller, f.file().Stat(), mask) {
+		return syscall.EACCES
+	}
+	return noError
+}
+
+// checkAddEntry checks that the caller may add entries to the directory f.
+func (f *FS) checkAddEntry(ctx context.Context) errno {
+	if e := f.st.checkWritable(); e != noError {
+		return e
+	}
+	return f.checkAccess(ctx, permWrite|permExec)
+}
+
+// checkRemoveEntry checks that the caller may remove the entry for kid from
+// the directory f. If f is sticky, only the owner of f or of kid may do so.
+func (f *FS) checkRemoveEntry(ctx context.Context, kid *file.File) errno {
+	if e := f.checkAddEntry(ctx); e != noError || !f.st.opts.StrictPermissions {
+		return e
+	}
+	caller, _ := fuse.FromContext(ctx) // checked above
+	if s := f.file().Stat(); s.Mode&os.ModeSticky != 0 && caller.Uid != 0 &&
+		int(caller.Uid) != s.OwnerID && int(caller.Uid) != kid.Stat().OwnerID {
+		return syscall.EPERM
+	}
+	return noError
+}
+
+// checkSetattr checks that the caller may make the changes requested by in to
+// f. If the request sets the mode of f, checkSetattr updates it to clear the
+// set-group-ID bit when the caller is not permitted to set it. The handle fh
+// may be nil.
+func (f *FS) checkSetattr(ctx context.Context, fh fs.FileHandle, in *fuse.SetAttrIn) errno {
+	if e := f.st.checkWritable(); e != noError || !f.st.opts.StrictPermissions {
+		return e
+	}
+	caller, ok := fuse.FromContext(ctx)
+	if !ok {
+		return syscall.ENOSYS
+	}
+	s := f.file().Stat()
+	isRoot := caller.Uid == 0
+	isOwner := isRoot || int(caller.Uid) == s.OwnerID
+
+	if _, ok := in.GetSize(); ok {
+		// Truncating through a writable handle does not require permission.
+		if h, ok := fh.(*fileHandle); !ok || !h.writable {
+			if !mayAccess(caller, s, permWrite) {
+				return syscall.EACCES
+			}
+		}
+	}
+	if uid, ok := in.GetUID(); ok && int(uid) != s.OwnerID && !isRoot {
+		return syscall.EPERM // only root may give a file away
+	}
+	if gid, ok := in.GetGID(); ok && int(gid) != s.GroupID {
+		if !isRoot && (!isOwner || !inGroup(caller, int(gid))) {
+			return syscall.EPERM // the owner may choose among their own groups
+		}
+	}
+	if m, ok := in.GetMode(); ok {
+		if !isOwner {
+			return syscall.EPERM
+		}
+		gid := s.GroupID
+		if g, ok := in.GetGID(); ok {
+			gid = int(g)
+		}
+		if !isRoot && !inGroup(caller, gid) {
+			in.Mode = m &^ syscall.S_ISGID
+		}
+	}
+	_, setA := in.GetATime()
+	_, setM := in.GetMTime()
+	if (setA || setM) && !isOwner {
+		// Anyone with write permission may set the times to now, but only the
+		// owner may set an explicit time.
+		if (setA && in.Valid&fuse.FATTR_ATIME_NOW == 0) || (setM && in.Valid&fuse.FATTR_MTIME_NOW == 0) {
+			return syscall.EPERM
+		} else if !mayAccess(caller, s, permWrite) {
+			return syscall.EACCES
+		}
+	}
+	return noError
+}
+
+// checkSetxattr checks that the caller may set or remove the extended
+// attribute attr of f.
+func (f *FS) checkSetxattr(ctx context.Context, attr string) errno {
+	if e := f.st.checkWritable(); e != noError || !f.st.opts.StrictPermissions {
+		return e
+	}
+	caller, ok := fuse.FromContext(ctx)
+	if !ok {
+		return syscall.ENOSYS
+	}
+	if strings.HasPrefix(attr, "trusted.") && caller.Uid != 0 {
+		return syscall.EPERM
+	}
+	return f.checkAccess(ctx, permWrite)
+}
+
+// checkRename checks that the caller may move cf from the directory f to the
+// directory np, replacing tf if it is not nil, or exchanging cf and tf if
+// exchange is true.
+func (f *FS) checkRename(ctx context.Context, np *FS, cf, tf *file.File, exchange bool) errno {
+	if e := f.checkRemoveEntry(ctx, cf); e != noError {
+		return e
+	}
+	if tf != nil {
+		if e := np.checkRemoveEntry(ctx, tf); e != noError {
+			return e
+		}
+	} else if e := np.checkAddEntry(ctx); e != noError {
+		return e
+	}
+	if f == np || !f.st.opts.StrictPermissions {
+		return noError
+	}
+
+	// Moving a directory to a new parent updates its ".." entry, which
+	// requires permission to write the directory.
+	caller, _ := fuse.FromContext(ctx) // checked above
+	moved := []*file.File{cf}
+	if exchange {
+		moved = append(moved, tf)
+	}
+	for _, m := range moved {
+		if s := m.Stat(); s.Mode.IsDir() && !mayAccess(caller, s, permWrite) {
+			return syscall.EACCES
+		}
+	}
+	return noError
+}
+
+// checkOwner checks that the caller owns f, or is root.
+func (f *FS) checkOwner(ctx context.Context) errno {
+	if !f.st.opts.StrictPermissions {
+		return noError
+	}
+	caller, ok := fuse.FromContext(ctx)
+	if !ok {
+		return syscall.ENOSYS
+	}
+	if caller.Uid != 0 && int(caller.Uid) != f.file().Stat().OwnerID {
+		return syscall.EPERM
+	}
+	return noError
+}
@@ -0,0 +1,49 @@
+// Copyright 2019 Michael J. Fromberger. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ffuse
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// callerGroups returns the supplementary group IDs of the process with the
+// given pid, Linux version. FUSE does not report them with the request, so we
+// read them from the process status. If they are not available, for example
+// because the process has exited, callerGroups returns nil.
+func callerGroups(pid uint32) []uint32 {
+	f, err := os.Open("/proc/" + strconv.FormatUint(uint64(pid), 10) + "/status")
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		rest, ok := strings.CutPrefix(sc.Text(), "Groups:")
+		if !ok {
+			continue
+		}
+		var gids []uint32
+		for _, s := range strings.Fields(rest) {
+			if v, err := strconv.ParseUint(s, 10, 32); err == nil {
+				gids = append(gids, uint32(v))
+			}
+		}
+		return gids
+	}
+	return nil
+}
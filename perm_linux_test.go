@@ -0,0 +1,55 @@
+// Copyright 2019 Michael J. Fromberger. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ffuse_test
+
+import (
+	"os/exec"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestSetattrSupplementaryGroup(t *testing.T) {
+	// The supplementary groups of a caller are read from its process, so
+	// start one with known groups. That requires privilege.
+	const uid, gid, group = 1000, 1000, 4000
+	cmd := exec.Command("sleep", "60")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Credential: &syscall.Credential{
+		Uid: uid, Gid: gid, Groups: []uint32{group},
+	}}
+	if err := cmd.Start(); err != nil {
+		t.Skipf("Cannot start a process with supplementary groups: %v", err)
+	}
+	t.Cleanup(func() { cmd.Process.Kill(); cmd.Wait() })
+
+	root, ctx := newStrictFS(t, 0777)
+	ctx = fuse.NewContext(ctx, &fuse.Caller{Owner: fuse.Owner{Uid: uid, Gid: gid}, Pid: uint32(cmd.Process.Pid)})
+	f := createFile(t, ctx, root, "f", "")
+	chgrp := func(gid uint32) syscall.Errno {
+		return setattr(ctx, f, &fuse.SetAttrIn{SetAttrInCommon: fuse.SetAttrInCommon{
+			Valid: fuse.FATTR_GID, Owner: fuse.Owner{Gid: gid},
+		}})
+	}
+	if e := chgrp(group); e != 0 {
+		t.Errorf("Chgrp to supplementary group %d: %v", group, e)
+	}
+	if e := chgrp(group + 1); e != syscall.EPERM {
+		t.Errorf("Chgrp to group %d: got %v, want %v", group+1, e, syscall.EPERM)
+	}
+	if attr := getAttr(t, ctx, f); attr.Gid != group {
+		t.Errorf("After chgrp: got group %d, want %d", attr.Gid, group)
+	}
+}
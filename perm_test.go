@@ -0,0 +1,158 @@
+// Copyright 2019 Michael J. Fromberger. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ffuse_test
+
+import (
+	"context"
+	"syscall"
+	"testing"
+
+	"github.com/creachadair/ffuse"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// asUser returns a context for requests from the given user and group.
+func asUser(ctx context.Context, uid, gid uint32) context.Context {
+	return fuse.NewContext(ctx, &fuse.Caller{Owner: fuse.Owner{Uid: uid, Gid: gid}})
+}
+
+// setattr applies in to node, and returns the result.
+func setattr(ctx context.Context, node *ffuse.FS, in *fuse.SetAttrIn) syscall.Errno {
+	return node.Setattr(ctx, nil, in, new(fuse.AttrOut))
+}
+
+// newStrictFS returns the root of an empty FS that checks permissions, with
+// the given mode, along with a context for requests from user 1000.
+func newStrictFS(t *testing.T, mode uint32) (*ffuse.FS, context.Context) {
+	t.Helper()
+	root, ctx := newTestFSOptions(t, &ffuse.Options{StrictPermissions: true})
+	in := &fuse.SetAttrIn{SetAttrInCommon: fuse.SetAttrInCommon{Valid: fuse.FATTR_MODE, Mode: mode}}
+	if e := setattr(asUser(ctx, 0, 0), root, in); e != 0 {
+		t.Fatalf("Setattr mode %o: %v", mode, e)
+	}
+	return root, ctx
+}
+
+func TestStickyDirectory(t *testing.T) {
+	root, ctx := newStrictFS(t, 01777)
+	other := asUser(ctx, 2000, 2000)
+	for _, name := range []string{"a", "b", "c"} {
+		createFile(t, ctx, root, name, "")
+	}
+
+	// In a sticky directory, only the owner of an entry, the owner of the
+	// directory, and root may remove or rename it.
+	if e := root.Unlink(other, "a"); e != syscall.EPERM {
+		t.Errorf("Unlink by another user: got %v, want %v", e, syscall.EPERM)
+	}
+	if e := root.Rename(other, "a", root, "z", 0); e != syscall.EPERM {
+		t.Errorf("Rename by another user: got %v, want %v", e, syscall.EPERM)
+	}
+	if e := root.Unlink(ctx, "a"); e != 0 {
+		t.Errorf("Unlink by the owner: %v", e)
+	}
+	if e := root.Unlink(asUser(ctx, 0, 0), "b"); e != 0 {
+		t.Errorf("Unlink by root: %v", e)
+	}
+
+	// Without the sticky bit, write permission on the directory suffices.
+	in := &fuse.SetAttrIn{SetAttrInCommon: fuse.SetAttrInCommon{Valid: fuse.FATTR_MODE, Mode: 0777}}
+	if e := setattr(asUser(ctx, 0, 0), root, in); e != 0 {
+		t.Fatalf("Setattr: %v", e)
+	}
+	if e := root.Unlink(other, "c"); e != 0 {
+		t.Errorf("Unlink by another user without sticky bit: %v", e)
+	}
+}
+
+func TestSetattrOwner(t *testing.T) {
+	root, ctx := newStrictFS(t, 0777)
+	f := createFile(t, ctx, root, "f", "")
+	owner := func(uid, gid uint32, valid uint32) *fuse.SetAttrIn {
+		return &fuse.SetAttrIn{SetAttrInCommon: fuse.SetAttrInCommon{
+			Valid: valid, Owner: fuse.Owner{Uid: uid, Gid: gid},
+		}}
+	}
+
+	// Only root may give a file away, or change its group to one the owner
+	// is not a member of.
+	if e := setattr(ctx, f, owner(2000, 0, fuse.FATTR_UID)); e != syscall.EPERM {
+		t.Errorf("Chown by the owner: got %v, want %v", e, syscall.EPERM)
+	}
+	if e := setattr(ctx, f, owner(0, 2000, fuse.FATTR_GID)); e != syscall.EPERM {
+		t.Errorf("Chgrp to another group: got %v, want %v", e, syscall.EPERM)
+	}
+	if e := setattr(asUser(ctx, 2000, 2000), f, owner(0, 2000, fuse.FATTR_GID)); e != syscall.EPERM {
+		t.Errorf("Chgrp by another user: got %v, want %v", e, syscall.EPERM)
+	}
+	if e := setattr(ctx, f, owner(1000, 1000, fuse.FATTR_UID|fuse.FATTR_GID)); e != 0 {
+		t.Errorf("Chown to the current owner: %v", e)
+	}
+	if e := setattr(asUser(ctx, 0, 0), f, owner(2000, 2000, fuse.FATTR_UID|fuse.FATTR_GID)); e != 0 {
+		t.Errorf("Chown by root: %v", e)
+	}
+	if attr := getAttr(t, ctx, f); attr.Uid != 2000 || attr.Gid != 2000 {
+		t.Errorf("After chown: got %d:%d, want 2000:2000", attr.Uid, attr.Gid)
+	}
+}
+
+func TestSetattrTimes(t *testing.T) {
+	root, ctx := newStrictFS(t, 0777)
+	shared := createFile(t, ctx, root, "shared", "")
+	private := createFile(t, ctx, root, "private", "")
+	for _, tc := range []struct {
+		node *ffuse.FS
+		mode uint32
+	}{{shared, 0666}, {private, 0644}} {
+		in := &fuse.SetAttrIn{SetAttrInCommon: fuse.SetAttrInCommon{Valid: fuse.FATTR_MODE, Mode: tc.mode}}
+		if e := setattr(ctx, tc.node, in); e != 0 {
+			t.Fatalf("Setattr mode: %v", e)
+		}
+	}
+
+	// Another user with write permission may set either time to now, but not
+	// to an explicit time; without write permission it may do neither.
+	other := asUser(ctx, 2000, 2000)
+	for _, tc := range []struct {
+		node  *ffuse.FS
+		valid uint32
+		want  syscall.Errno
+	}{
+		{shared, fuse.FATTR_ATIME | fuse.FATTR_ATIME_NOW, 0},
+		{shared, fuse.FATTR_MTIME | fuse.FATTR_MTIME_NOW, 0},
+		{shared, fuse.FATTR_ATIME | fuse.FATTR_ATIME_NOW | fuse.FATTR_MTIME | fuse.FATTR_MTIME_NOW, 0},
+		{shared, fuse.FATTR_ATIME, syscall.EPERM},
+		{shared, fuse.FATTR_MTIME, syscall.EPERM},
+		{shared, fuse.FATTR_ATIME | fuse.FATTR_MTIME | fuse.FATTR_MTIME_NOW, syscall.EPERM},
+		{private, fuse.FATTR_ATIME | fuse.FATTR_ATIME_NOW, syscall.EACCES},
+		{private, fuse.FATTR_MTIME | fuse.FATTR_MTIME_NOW, syscall.EACCES},
+	} {
+		in := &fuse.SetAttrIn{SetAttrInCommon: fuse.SetAttrInCommon{Valid: tc.valid, Atime: 1, Mtime: 1}}
+		if e := setattr(other, tc.node, in); e != tc.want {
+			t.Errorf("Setattr %#x by another user: got %v, want %v", tc.valid, e, tc.want)
+		}
+	}
+
+	// The owner may set explicit times.
+	in := &fuse.SetAttrIn{SetAttrInCommon: fuse.SetAttrInCommon{
+		Valid: fuse.FATTR_ATIME | fuse.FATTR_MTIME, Atime: 1000, Mtime: 2000,
+	}}
+	if e := setattr(ctx, private, in); e != 0 {
+		t.Errorf("Setattr times by the owner: %v", e)
+	}
+	if attr := getAttr(t, ctx, private); attr.Atime != 1000 || attr.Mtime != 2000 {
+		t.Errorf("After Setattr: got atime=%d mtime=%d, want 1000, 2000", attr.Atime, attr.Mtime)
+	}
+}
@@ -0,0 +1,256 @@
+// Copyright 2019 Michael J. Fromberger. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ffuse
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"maps"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/creachadair/ffs/file/root"
+	"github.com/creachadair/ffs/filetree"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// Roots is a filesystem root that lists the root pointers of a store as
+// subdirectories. The file tree of each root is loaded when its name is first
+// looked up, and thereafter is served as an [FS] until the filesystem is
+// unmounted. The listing is read from the store each time, so roots added to
+// the store while the filesystem is mounted appear in it.
+//
+// The name of each subdirectory is the key of its root pointer, with "%" and
+// "/" escaped as "%25" and "%2F" respectively.
+//
+// Changes to a tree are not written back to the store until the caller calls
+// [Roots.Flush], which the driver does periodically and at unmount.
+//
+// Names cannot be renamed or linked from one tree to another.
+type Roots struct {
+	fs.Inode
+
+	store filetree.Store
+	opts  RootsOptions
+	nodes *nodeTable // live nodes of all the trees
+
+	mu    sync.Mutex
+	trees map[string]*rootTree // loaded trees, by root key
+
+	flushMu sync.Mutex // serializes calls to Flush
+}
+
+// RootsOptions are settings for a [Roots] filesystem.
+type RootsOptions struct {
+	// Tree gives the settings for the tree of each root. Its Store is replaced
+	// by the store of the roots, and its Control is ignored.
+	Tree Options
+
+	// Writable, if set, reports whether the tree of the given root key may be
+	// modified. If nil, every tree may be modified unless Tree.ReadOnly is set.
+	Writable func(rootKey string) bool
+}
+
+// A rootTree is the file tree of a root pointer loaded by a Roots.
+type rootTree struct {
+	path *filetree.PathInfo
+	node *FS
+}
+
+// NewRoots constructs a new Roots listing the root pointers of store.
+// If opts == nil, default options are used.
+func NewRoots(store filetree.Store, opts *RootsOptions) *Roots {
+	r := &Roots{store: store, nodes: new(nodeTable)}
+	if opts != nil {
+		r.opts = *opts
+	}
+	return r
+}
+
+var (
+	_ fs.NodeGetattrer = (*Roots)(nil)
+	_ fs.NodeLookuper  = (*Roots)(nil)
+	_ fs.NodeReaddirer = (*Roots)(nil)
+)
+
+// Getattr implements the [fs.NodeGetattrer] interface.
+func (r *Roots) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) errno {
+	out.Mode = syscall.S_IFDIR | 0555
+	out.Nlink = 2
+	out.Owner.Uid = uint32(os.Getuid())
+	out.Owner.Gid = uint32(os.Getgid())
+	return noError
+}
+
+// Readdir implements the [fs.NodeReaddirer] interface.
+func (r *Roots) Readdir(ctx context.Context) (fs.DirStream, errno) {
+	var keys []string
+	for key, err := range r.store.Roots().List(ctx, "") {
+		if err != nil {
+			return nil, errorToErrno(err)
+		}
+		keys = append(keys, key)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var ents []fuse.DirEntry
+	for _, key := range keys {
+		name := escapeRootKey(key)
+		if name == "." || name == ".." {
+			continue // not a usable name
+		}
+		ino := rootInode(key)
+		if t, ok := r.trees[key]; ok {
+			ino = t.node.StableAttr().Ino
+		}
+		ents = append(ents, fuse.DirEntry{Name: name, Mode: syscall.S_IFDIR, Ino: ino})
+	}
+	return fs.NewListDirStream(ents), noError
+}
+
+// Lookup implements the [fs.NodeLookuper] interface.
+func (r *Roots) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, errno) {
+	key, err := url.PathUnescape(name)
+	if err != nil || escapeRootKey(key) != name {
+		return nil, syscall.ENOENT // not a name listed by Readdir
+	}
+	r.mu.Lock()
+	t, ok := r.trees[key]
+	r.mu.Unlock()
+	if !ok {
+		// Load the tree without holding the lock, so that a slow fetch does
+		// not stall lookups of other roots. If another lookup of the same root
+		// wins the race, use its tree and discard ours.
+		path, err := r.loadTree(ctx, key)
+		if errors.Is(err, root.ErrNoData) {
+			return nil, syscall.ENOENT
+		} else if err != nil {
+			return nil, errorToErrno(err)
+		}
+		r.mu.Lock()
+		t, ok = r.trees[key]
+		if !ok {
+			t = r.newTree(ctx, path)
+			if r.trees == nil {
+				r.trees = make(map[string]*rootTree)
+			}
+			r.trees[key] = t
+		}
+		r.mu.Unlock()
+	}
+	t.node.fillAttr(ctx, &out.Attr)
+	return t.node.EmbeddedInode(), noError
+}
+
+// loadTree loads the root pointer of the given key and the root file of its
+// tree from the store.
+func (r *Roots) loadTree(ctx context.Context, key string) (*filetree.PathInfo, error) {
+	rp, err := root.Open(ctx, r.store.Roots(), key)
+	if err != nil {
+		return nil, err
+	}
+	rf, err := rp.File(ctx, r.store.Files())
+	if err != nil {
+		return nil, err
+	}
+	return &filetree.PathInfo{
+		Path:    key,
+		Base:    rf,
+		BaseKey: rf.Key(),
+		File:    rf,
+		FileKey: rp.FileKey,
+		Root:    rp,
+		RootKey: key,
+	}, nil
+}
+
+// newTree constructs a node to serve the tree loaded by loadTree.
+// The caller must hold r.mu.
+func (r *Roots) newTree(ctx context.Context, path *filetree.PathInfo) *rootTree {
+	key, rf := path.RootKey, path.Base
+	opts := r.opts.Tree
+	opts.Store = r.store
+	opts.Control = nil
+	opts.ReadOnly = opts.ReadOnly || (r.opts.Writable != nil && !r.opts.Writable(key))
+	node := newTree(rf, &opts, r.nodes)
+	node.st.salt = rootInode(key)
+
+	// The root of each tree is persistent, so that the tree and any changes
+	// not yet flushed outlive the kernel's interest in it.
+	r.nodes.mu.Lock()
+	ino, _ := r.nodes.find(node.st.inode(1), rf)
+	r.nodes.add(ino, node)
+	r.nodes.mu.Unlock()
+	r.NewPersistentInode(ctx, node, fs.StableAttr{
+		Mode: modeFileType(rf.Stat().Mode),
+		Ino:  ino,
+	})
+	return &rootTree{path: path, node: node}
+}
+
+// Flush flushes the tree of each loaded root that may be modified, and if the
+// storage key of the tree has changed, updates its root pointer. Roots may be
+// looked up and loaded while it does so.
+func (r *Roots) Flush(ctx context.Context) error {
+	r.flushMu.Lock()
+	defer r.flushMu.Unlock()
+	r.mu.Lock()
+	trees := maps.Clone(r.trees)
+	r.mu.Unlock()
+
+	var errs []error
+	for key, t := range trees {
+		if t.node.st.readOnly.Load() {
+			continue
+		}
+		// Changes to a file do not invalidate the key of its parent, so flush
+		// the tree to find out whether it has changed.
+		if fkey, err := t.path.Base.Flush(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("flush root %q: %w", key, err))
+			continue
+		} else if fkey == t.path.BaseKey {
+			continue // no changes
+		}
+		fkey, err := t.path.Flush(ctx)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("update root %q: %w", key, err))
+			continue
+		}
+		t.path.FileKey = fkey
+	}
+	return errors.Join(errs...)
+}
+
+// rootInode returns the default inode number for the tree of the given root
+// key, derived from the key.
+func rootInode(key string) uint64 {
+	h := fnv.New64a()
+	h.Write(binary.LittleEndian.AppendUint64(nil, 1)) // the number of the root
+	h.Write([]byte(key))
+	return validInode(h.Sum64())
+}
+
+// escapeRootKey returns the directory name for the given root key.
+func escapeRootKey(key string) string {
+	return strings.NewReplacer("%", "%25", "/", "%2F").Replace(key)
+}
@@ -0,0 +1,202 @@
+// Copyright 2019 Michael J. Fromberger. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ffuse_test
+
+import (
+	"context"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/creachadair/ffs/blob"
+	"github.com/creachadair/ffs/blob/memstore"
+	"github.com/creachadair/ffs/file"
+	"github.com/creachadair/ffs/file/root"
+	"github.com/creachadair/ffs/filetree"
+	"github.com/creachadair/ffuse"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// blockKey marks a context whose reads from a gateKV block.
+type blockKey struct{}
+
+// A gateKV is a blob.KV whose reads block while the context of the request
+// carries a channel under blockKey, until that channel is closed.
+type gateKV struct{ blob.KV }
+
+func (g gateKV) Get(ctx context.Context, key string) ([]byte, error) {
+	if ch, ok := ctx.Value(blockKey{}).(chan struct{}); ok {
+		<-ch
+	}
+	return g.KV.Get(ctx, key)
+}
+
+// newTestRoots returns a Roots serving a store with an empty tree saved under
+// each of the given root keys, along with the store and a context for requests.
+func newTestRoots(t *testing.T, opts *ffuse.RootsOptions, keys ...string) (*ffuse.Roots, filetree.Store, context.Context) {
+	t.Helper()
+	st, err := filetree.NewStore(t.Context(), memstore.New(func() blob.KV {
+		return gateKV{memstore.NewKV()}
+	}))
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+	for _, key := range keys {
+		rf := file.New(st.Files(), &file.NewOptions{Stat: &file.Stat{Mode: os.ModeDir | 0755}})
+		fkey, err := rf.Flush(t.Context())
+		if err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+		if err := root.New(st.Roots(), &root.Options{FileKey: fkey}).Save(t.Context(), key); err != nil {
+			t.Fatalf("Save root %q: %v", key, err)
+		}
+	}
+	r := ffuse.NewRoots(st, opts)
+	fs.NewNodeFS(r, &fs.Options{})
+	ctx := fuse.NewContext(t.Context(), &fuse.Caller{Owner: fuse.Owner{Uid: 1000, Gid: 1000}})
+	return r, st, ctx
+}
+
+// lookupRoot looks up name in r, and returns the root of its tree.
+func lookupRoot(t *testing.T, ctx context.Context, r *ffuse.Roots, name string) *ffuse.FS {
+	t.Helper()
+	in, e := r.Lookup(ctx, name, new(fuse.EntryOut))
+	if e != 0 {
+		t.Fatalf("Lookup %q: %v", name, e)
+	}
+	return in.Operations().(*ffuse.FS)
+}
+
+func TestRootsLookup(t *testing.T) {
+	r, _, ctx := newTestRoots(t, nil, "a", "b/c", "50%")
+
+	ds, e := r.Readdir(ctx)
+	if e != 0 {
+		t.Fatalf("Readdir: %v", e)
+	}
+	var names []string
+	for ds.HasNext() {
+		de, e := ds.Next()
+		if e != 0 {
+			t.Fatalf("Next: %v", e)
+		}
+		names = append(names, de.Name)
+	}
+	want := map[string]bool{"a": true, "b%2Fc": true, "50%25": true}
+	if len(names) != len(want) {
+		t.Errorf("Readdir: got %q, want %d names", names, len(want))
+	}
+	for _, name := range names {
+		if !want[name] {
+			t.Errorf("Readdir: unexpected name %q", name)
+		}
+		lookupRoot(t, ctx, r, name)
+	}
+
+	// Names that are not listed, including other spellings of listed names,
+	// are not found.
+	for _, name := range []string{"nonesuch", "b%2fc", "50%"} {
+		if _, e := r.Lookup(ctx, name, new(fuse.EntryOut)); e != syscall.ENOENT {
+			t.Errorf("Lookup %q: got %v, want %v", name, e, syscall.ENOENT)
+		}
+	}
+
+	// Concurrent lookups of a root not yet loaded all get the same tree.
+	r, _, ctx = newTestRoots(t, nil, "a")
+	nodes := make([]*ffuse.FS, numWorkers)
+	var wg sync.WaitGroup
+	for i := range nodes {
+		wg.Go(func() { nodes[i] = lookupRoot(t, ctx, r, "a") })
+	}
+	wg.Wait()
+	for i, n := range nodes {
+		if n != nodes[0] {
+			t.Errorf("Lookup %d: got a different tree than lookup 0", i)
+		}
+	}
+}
+
+func TestRootsLookupBlocked(t *testing.T) {
+	r, _, ctx := newTestRoots(t, nil, "a", "b")
+
+	// While the tree of one root is being loaded, lookups of another root
+	// proceed.
+	release := make(chan struct{})
+	done := make(chan *ffuse.FS)
+	go func() { done <- lookupRoot(t, context.WithValue(ctx, blockKey{}, release), r, "a") }()
+	time.Sleep(10 * time.Millisecond)
+
+	got := make(chan *ffuse.FS)
+	go func() { got <- lookupRoot(t, ctx, r, "b") }()
+	select {
+	case <-got:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Lookup of b was blocked by the load of a")
+	}
+
+	close(release)
+	if a := <-done; a != lookupRoot(t, ctx, r, "a") {
+		t.Error("Lookup of a after loading: got a different tree")
+	}
+}
+
+func TestRootsFlush(t *testing.T) {
+	r, st, ctx := newTestRoots(t, &ffuse.RootsOptions{
+		Writable: func(key string) bool { return key != "ro" },
+	}, "rw", "ro")
+
+	// A tree that is not writable cannot be modified.
+	ro := lookupRoot(t, ctx, r, "ro")
+	if _, e := ro.Mkdir(ctx, "d", 0755, new(fuse.EntryOut)); e != syscall.EROFS {
+		t.Errorf("Mkdir in a read-only tree: got %v, want %v", e, syscall.EROFS)
+	}
+
+	// Changes to a writable tree are saved to its root pointer by Flush.
+	rw := lookupRoot(t, ctx, r, "rw")
+	createFile(t, ctx, rw, "f", "hello, world")
+	rp, err := root.Open(ctx, st.Roots(), "rw")
+	if err != nil {
+		t.Fatalf("Open root: %v", err)
+	}
+	old := rp.FileKey
+	if err := r.Flush(ctx); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	rp, err = root.Open(ctx, st.Roots(), "rw")
+	if err != nil {
+		t.Fatalf("Open root: %v", err)
+	}
+	if rp.FileKey == old {
+		t.Fatal("Flush did not update the root pointer")
+	}
+	rf, err := rp.File(ctx, st.Files())
+	if err != nil {
+		t.Fatalf("Open root file: %v", err)
+	}
+	if _, err := rf.Open(ctx, "f"); err != nil {
+		t.Errorf("Open f in the flushed tree: %v", err)
+	}
+
+	// Without further changes, Flush leaves the root pointer alone.
+	if err := r.Flush(ctx); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if rp2, err := root.Open(ctx, st.Roots(), "rw"); err != nil || rp2.FileKey != rp.FileKey {
+		t.Errorf("Root after a clean flush: got %v, %v; want key %x", rp2, err, rp.FileKey)
+	}
+}
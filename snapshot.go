@@ -0,0 +1,72 @@
+// Copyright 2019 Michael J. Fromberger. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ffuse
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"syscall"
+
+	"github.com/creachadair/ffs/blob"
+	"github.com/creachadair/ffs/file/root"
+)
+
+// ffsSnapshot is a write-only attribute of a directory. Setting it flushes
+// the directory and writes a root pointer for it to the store. The value is
+// the name of the root, optionally followed by a space and a description:
+//
+//	setfattr -n ffs.snapshot -v "jobs/output Output of the nightly job" dir
+//
+// An existing root with the same name is replaced, unless the XATTR_CREATE
+// flag is set. If the XATTR_REPLACE flag is set, the root must already exist.
+const ffsSnapshot = "ffs.snapshot"
+
+// snapshot writes a root pointer for the directory f as specified by data,
+// the value of ffsSnapshot.
+func (f *FS) snapshot(ctx context.Context, data []byte, flags uint32) errno {
+	if !f.file().Stat().Mode.IsDir() {
+		return syscall.EPERM // only allow snapshots of a directory
+	} else if !f.st.opts.Store.IsValid() {
+		return syscall.ENOTSUP // no store to write roots
+	} else if e := f.checkAccess(ctx, permRead); e != noError {
+		return e
+	}
+	name, desc, _ := strings.Cut(string(data), " ")
+	if name == "" {
+		return syscall.EINVAL
+	}
+
+	roots := f.st.opts.Store.Roots()
+	_, err := root.Open(ctx, roots, name)
+	exists := err == nil
+	if err != nil && !errors.Is(err, blob.ErrKeyNotFound) {
+		return errorToErrno(err)
+	} else if exists && flags&xattrCreate != 0 {
+		return syscall.EEXIST
+	} else if !exists && flags&xattrReplace != 0 {
+		return xattrErrnoNotFound
+	}
+
+	key, err := f.file().Flush(ctx)
+	if err != nil {
+		return errorToErrno(err)
+	}
+	rp := root.New(roots, &root.Options{FileKey: key, Description: desc})
+	if err := rp.Save(ctx, name); err != nil {
+		return errorToErrno(err)
+	}
+	return noError
+}
@@ -0,0 +1,161 @@
+// Copyright 2019 Michael J. Fromberger. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ffuse
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/creachadair/ffs/file"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// An AtimePolicy controls when the access times of files are updated.
+type AtimePolicy int
+
+const (
+	// NoAtime does not update access times. This is the default, since an
+	// update changes the storage key of the file and its ancestors.
+	NoAtime AtimePolicy = iota
+
+	// RelAtime updates the access time of a file when it is accessed, if the
+	// previous access time is older than the last modification or change of
+	// the file, or more than a day old. This is the Linux default.
+	RelAtime
+
+	// StrictAtime updates the access time of a file on every access.
+	StrictAtime
+)
+
+func (p AtimePolicy) String() string {
+	switch p {
+	case NoAtime:
+		return "noatime"
+	case RelAtime:
+		return "relatime"
+	case StrictAtime:
+		return "strictatime"
+	default:
+		return fmt.Sprintf("AtimePolicy(%d)", int(p))
+	}
+}
+
+// relAtimeInterval is the maximum age of an access time under RelAtime.
+const relAtimeInterval = 24 * time.Hour
+
+// Only the modification time of a file is stored in its stat. The access,
+// change, and birth times are stored as driver metadata, in nanoseconds since
+// the Unix epoch. A file without a recorded access or change time reports its
+// modification time instead, and a file without a recorded birth time does
+// not report one.
+//
+// The file package updates the modification time of a file when its contents
+// change, without recording a change time. Since a change to the contents is
+// also a change to the file, the change time of a file is reported as the
+// later of its recorded change time and its modification time.
+
+// getTime returns the time recorded in the metadata attribute name of f, and
+// reports whether it was present.
+func getTime(f *file.File, name string) (time.Time, bool) {
+	v, err := strconv.ParseInt(f.XAttr().Get(name), 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(0, v), true
+}
+
+// setTime records t in the metadata attribute name of f.
+func setTime(f *file.File, name string, t time.Time) {
+	f.XAttr().Set(name, strconv.FormatInt(t.UnixNano(), 10))
+}
+
+// fileTimes returns the access and change times of f.
+func fileTimes(f *file.File) (atime, ctime time.Time) {
+	mtime := f.Stat().ModTime
+	atime, ok := getTime(f, metaAtime)
+	if !ok {
+		atime = mtime
+	}
+	ctime, ok = getTime(f, metaCtime)
+	if !ok || ctime.Before(mtime) {
+		ctime = mtime
+	}
+	return atime, ctime
+}
+
+// touchChange records the current time as the change time of f.
+func touchChange(f *file.File) { setTime(f, metaCtime, time.Now()) }
+
+// touchAccess records the current time as the access time of f, if the
+// access time policy of the tree requires it.
+func (s *fsState) touchAccess(f *file.File) {
+	if s.readOnly.Load() {
+		return
+	}
+	switch s.opts.Atime {
+	case RelAtime:
+		atime, ctime := fileTimes(f)
+		if atime.After(ctime) && atime.After(f.Stat().ModTime) && time.Since(atime) < relAtimeInterval {
+			return
+		}
+	case StrictAtime:
+		// always update
+	default:
+		return
+	}
+	s.noteChange()
+	setTime(f, metaAtime, time.Now())
+}
+
+// setAttrTime sets a time in out to t.
+func setAttrTime(sec *uint64, nsec *uint32, t time.Time) {
+	*sec = uint64(t.Unix())        // seconds
+	*nsec = uint32(t.Nanosecond()) // nanoseconds within second
+}
+
+// Mask bits for statx(2).
+// These are not exposed in the syscall package.
+const (
+	statxBasicStats = 0x7ff // STATX_BASIC_STATS
+	statxBtime      = 0x800 // STATX_BTIME
+)
+
+// Statx implements the [fs.NodeStatxer] interface.
+func (f *FS) Statx(ctx context.Context, fh fs.FileHandle, flags, mask uint32, out *fuse.StatxOut) errno {
+	var attr fuse.Attr
+	f.fillAttr(ctx, &attr)
+
+	out.Mask = statxBasicStats
+	out.Blksize = attr.Blksize
+	out.Nlink = attr.Nlink
+	out.Uid = attr.Uid
+	out.Gid = attr.Gid
+	out.Mode = uint16(attr.Mode)
+	out.Size = attr.Size
+	out.Blocks = attr.Blocks
+	out.Atime = fuse.SxTime{Sec: attr.Atime, Nsec: attr.Atimensec}
+	out.Mtime = fuse.SxTime{Sec: attr.Mtime, Nsec: attr.Mtimensec}
+	out.Ctime = fuse.SxTime{Sec: attr.Ctime, Nsec: attr.Ctimensec}
+	out.RdevMajor = (attr.Rdev >> 8) & 0xfff
+	out.RdevMinor = (attr.Rdev & 0xff) | ((attr.Rdev >> 12) & 0xfff00)
+	if bt, ok := getTime(f.file(), metaBtime); ok {
+		setAttrTime(&out.Btime.Sec, &out.Btime.Nsec, bt)
+		out.Mask |= statxBtime
+	}
+	return noError
+}
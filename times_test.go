@@ -0,0 +1,194 @@
+// Copyright 2019 Michael J. Fromberger. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ffuse_test
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/creachadair/ffuse"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// fileTimes returns the access, modification, and change times of node.
+func fileTimes(t *testing.T, ctx context.Context, node *ffuse.FS) (atime, mtime, ctime time.Time) {
+	t.Helper()
+	attr := getAttr(t, ctx, node)
+	return time.Unix(int64(attr.Atime), int64(attr.Atimensec)),
+		time.Unix(int64(attr.Mtime), int64(attr.Mtimensec)),
+		time.Unix(int64(attr.Ctime), int64(attr.Ctimensec))
+}
+
+// tick waits long enough that the clock advances past any time already
+// recorded.
+func tick() { time.Sleep(2 * time.Millisecond) }
+
+func TestAtimePolicy(t *testing.T) {
+	for _, tc := range []struct {
+		policy       ffuse.AtimePolicy
+		stale, fresh bool // whether a read updates a stale or fresh atime
+	}{
+		{ffuse.NoAtime, false, false},
+		{ffuse.RelAtime, true, false},
+		{ffuse.StrictAtime, true, true},
+	} {
+		t.Run(tc.policy.String(), func(t *testing.T) {
+			root, ctx := newTestFSOptions(t, &ffuse.Options{Atime: tc.policy})
+			node := createFile(t, ctx, root, "f", "hello, world")
+			fr := openFile(t, ctx, node, syscall.O_RDONLY).(fs.FileReader)
+			read := func() {
+				t.Helper()
+				if _, e := fr.Read(ctx, make([]byte, 64), 0); e != 0 {
+					t.Fatalf("Read: %v", e)
+				}
+			}
+
+			// An access time older than the last change is stale.
+			in := &fuse.SetAttrIn{SetAttrInCommon: fuse.SetAttrInCommon{Valid: fuse.FATTR_ATIME, Atime: 1000}}
+			if e := setattr(ctx, node, in); e != 0 {
+				t.Fatalf("Setattr atime: %v", e)
+			}
+			old, _, _ := fileTimes(t, ctx, node)
+			tick()
+			read()
+			if atime, _, _ := fileTimes(t, ctx, node); atime.After(old) != tc.stale {
+				t.Errorf("Read with stale atime: atime %v, was %v; updated=%v, want %v",
+					atime, old, atime.After(old), tc.stale)
+			}
+
+			// An access time newer than the last change and modification is
+			// updated only by strictatime.
+			old, _, _ = fileTimes(t, ctx, node)
+			tick()
+			read()
+			if atime, _, _ := fileTimes(t, ctx, node); atime.After(old) != tc.fresh {
+				t.Errorf("Read with fresh atime: atime %v, was %v; updated=%v, want %v",
+					atime, old, atime.After(old), tc.fresh)
+			}
+		})
+	}
+}
+
+func TestSetattrTimeNow(t *testing.T) {
+	root, ctx := newTestFS(t)
+	node := createFile(t, ctx, root, "f", "")
+	in := &fuse.SetAttrIn{SetAttrInCommon: fuse.SetAttrInCommon{
+		Valid: fuse.FATTR_ATIME | fuse.FATTR_MTIME, Atime: 1000, Mtime: 1000,
+	}}
+	if e := setattr(ctx, node, in); e != 0 {
+		t.Fatalf("Setattr times: %v", e)
+	}
+
+	// UTIME_NOW sets the requested times to the current time, ignoring the
+	// values given in the request.
+	before := time.Now()
+	in.Valid = fuse.FATTR_ATIME | fuse.FATTR_ATIME_NOW | fuse.FATTR_MTIME | fuse.FATTR_MTIME_NOW
+	if e := setattr(ctx, node, in); e != 0 {
+		t.Fatalf("Setattr UTIME_NOW: %v", e)
+	}
+	after := time.Now()
+	atime, mtime, ctime := fileTimes(t, ctx, node)
+	for _, tc := range []struct {
+		name string
+		t    time.Time
+	}{{"atime", atime}, {"mtime", mtime}, {"ctime", ctime}} {
+		if tc.t.Before(before) || tc.t.After(after) {
+			t.Errorf("After UTIME_NOW: %s is %v, want between %v and %v", tc.name, tc.t, before, after)
+		}
+	}
+
+	// UTIME_NOW for one time leaves the other alone.
+	in.Valid = fuse.FATTR_MTIME | fuse.FATTR_MTIME_NOW
+	tick()
+	if e := setattr(ctx, node, in); e != 0 {
+		t.Fatalf("Setattr mtime UTIME_NOW: %v", e)
+	}
+	if got, gotm, _ := fileTimes(t, ctx, node); !got.Equal(atime) || !gotm.After(mtime) {
+		t.Errorf("After mtime UTIME_NOW: atime %v, mtime %v; want atime %v and mtime after %v", got, gotm, atime, mtime)
+	}
+}
+
+func TestChangeTime(t *testing.T) {
+	root, ctx := newTestFS(t)
+	node := createFile(t, ctx, root, "f", "hello")
+	dir := makeDir(t, ctx, root, "d")
+
+	for _, tc := range []struct {
+		name string
+		op   func() syscall.Errno
+	}{
+		{"Chmod", func() syscall.Errno {
+			return setattr(ctx, node, &fuse.SetAttrIn{SetAttrInCommon: fuse.SetAttrInCommon{Valid: fuse.FATTR_MODE, Mode: 0600}})
+		}},
+		{"Setxattr", func() syscall.Errno { return node.Setxattr(ctx, "user.test", []byte("x"), 0) }},
+		{"Removexattr", func() syscall.Errno { return node.Removexattr(ctx, "user.test") }},
+		{"Write", func() syscall.Errno {
+			_, e := openFile(t, ctx, node, syscall.O_WRONLY).(fs.FileWriter).Write(ctx, []byte("x"), 0)
+			return e
+		}},
+		{"Link", func() syscall.Errno {
+			_, e := dir.Link(ctx, node, "g", new(fuse.EntryOut))
+			return e
+		}},
+		{"Unlink", func() syscall.Errno { return dir.Unlink(ctx, "g") }},
+		{"Rename", func() syscall.Errno { return root.Rename(ctx, "f", root, "h", 0) }},
+	} {
+		_, _, old := fileTimes(t, ctx, node)
+		tick()
+		if e := tc.op(); e != 0 {
+			t.Fatalf("%s: %v", tc.name, e)
+		}
+		if _, _, ctime := fileTimes(t, ctx, node); !ctime.After(old) {
+			t.Errorf("%s: ctime %v, want after %v", tc.name, ctime, old)
+		}
+	}
+}
+
+func TestParentModTime(t *testing.T) {
+	root, ctx := newTestFS(t)
+	d1 := makeDir(t, ctx, root, "d1")
+	d2 := makeDir(t, ctx, root, "d2")
+
+	// check reports whether op updates the modification time of each of dirs.
+	check := func(name string, op func() syscall.Errno, dirs ...*ffuse.FS) {
+		t.Helper()
+		var old []time.Time
+		for _, d := range dirs {
+			_, mtime, _ := fileTimes(t, ctx, d)
+			old = append(old, mtime)
+		}
+		tick()
+		if e := op(); e != 0 {
+			t.Fatalf("%s: %v", name, e)
+		}
+		for i, d := range dirs {
+			if _, mtime, _ := fileTimes(t, ctx, d); !mtime.After(old[i]) {
+				t.Errorf("%s: directory %d mtime %v, want after %v", name, i+1, mtime, old[i])
+			}
+		}
+	}
+	check("Create", func() syscall.Errno {
+		_, fh, _, e := d1.Create(ctx, "f", syscall.O_CREAT|syscall.O_WRONLY, 0644, new(fuse.EntryOut))
+		if e == 0 {
+			fh.(fs.FileReleaser).Release(ctx)
+		}
+		return e
+	}, d1)
+	check("Rename", func() syscall.Errno { return d1.Rename(ctx, "f", d2, "g", 0) }, d1, d2)
+	check("Unlink", func() syscall.Errno { return d2.Unlink(ctx, "g") }, d2)
+}
@@ -0,0 +1,206 @@
+// Copyright 2019 Michael J. Fromberger. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ffuse
+
+import (
+	"context"
+
+	"github.com/creachadair/ffs/file"
+)
+
+const (
+	ffsTreePrefix       = "ffs.tree."
+	ffsTreeBytes        = ffsTreePrefix + "bytes"        // total bytes of file data
+	ffsTreeFiles        = ffsTreePrefix + "files"        // number of non-directory files
+	ffsTreeDirs         = ffsTreePrefix + "dirs"         // number of directories, including the root
+	ffsTreeUniqueBlocks = ffsTreePrefix + "uniqueBlocks" // number of distinct data blocks
+)
+
+// treeCacheLimit is the maximum number of directories whose statistics are
+// cached, and separately the maximum number of files whose sizes are cached.
+// When a cache is full, an arbitrary entry is evicted to make room.
+const treeCacheLimit = 1 << 16
+
+// A treeStats records statistics about a directory tree.
+//
+// Since a stored file cannot change, the statistics for a directory are cached
+// by its storage key, and are computed from the cached statistics of its
+// children. After a change, only the directories on the path to the change are
+// scanned again.
+type treeStats struct {
+	bytes int64 // total bytes of file data
+	files int64 // number of files other than directories
+	dirs  int64 // number of directories
+
+	// The number of distinct data blocks in the tree, or -1 if it has not been
+	// computed. This requires a full traversal, so it is filled in on demand.
+	blocks int64
+}
+
+// subtreeStats returns statistics about the directory whose storage key is
+// given. The file f is used to load files from storage.
+func (s *fsState) subtreeStats(ctx context.Context, f *file.File, key string) (*treeStats, error) {
+	s.mu.Lock()
+	t, ok := s.trees[key]
+	s.mu.Unlock()
+	if ok {
+		return t, nil
+	}
+
+	// Load a separate copy of the file, so that scanning does not populate the
+	// children of the files in the tree.
+	lf, err := f.Load(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	t = &treeStats{bytes: lf.Data().Size(), dirs: 1, blocks: -1}
+	for _, kid := range file.Encode(lf).GetNode().Children {
+		kkey := string(kid.Key)
+		if size, ok := s.fileSize(kkey); ok {
+			t.bytes += size
+			t.files++
+			continue
+		}
+		kf, err := f.Load(ctx, kkey)
+		if err != nil {
+			return nil, err
+		}
+		if !isTreeDir(kf) {
+			size := kf.Data().Size()
+			s.mu.Lock()
+			s.sizes = cacheEntry(s.sizes, kkey, size)
+			s.mu.Unlock()
+			t.bytes += size
+			t.files++
+			continue
+		}
+		kt, err := s.subtreeStats(ctx, f, kkey)
+		if err != nil {
+			return nil, err
+		}
+		t.bytes += kt.bytes
+		t.files += kt.files
+		t.dirs += kt.dirs
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.trees = cacheEntry(s.trees, key, t)
+	return t, nil
+}
+
+// fileSize reports the cached data size of the file with the given storage
+// key, if it is known to be a file other than a directory.
+func (s *fsState) fileSize(key string) (int64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	size, ok := s.sizes[key]
+	return size, ok
+}
+
+// isTreeDir reports whether f is counted as a directory in tree statistics.
+func isTreeDir(f *file.File) bool { return f.Stat().Mode.IsDir() || f.Child().Len() != 0 }
+
+// cacheEntry adds the entry (key, v) to m, allocating m if it is nil, and
+// returns the updated map. If m already has treeCacheLimit entries, an
+// arbitrary one of them is evicted first.
+func cacheEntry[V any](m map[string]V, key string, v V) map[string]V {
+	if m == nil {
+		m = make(map[string]V)
+	} else if len(m) >= treeCacheLimit {
+		for old := range m {
+			delete(m, old)
+			break
+		}
+	}
+	m[key] = v
+	return m
+}
+
+// uniqueBlocks returns the number of distinct data blocks in the directory tree
+// whose statistics are t and whose storage key is given. The result is saved
+// in t, so that later calls do not traverse the tree again.
+func (s *fsState) uniqueBlocks(ctx context.Context, f *file.File, key string, t *treeStats) (int64, error) {
+	s.mu.Lock()
+	n := t.blocks
+	s.mu.Unlock()
+	if n >= 0 {
+		return n, nil
+	}
+
+	// Files and directories with the same storage key have the same blocks, so
+	// each distinct subtree need only be visited once.
+	seen := make(map[string]bool)
+	blocks := make(map[string]struct{})
+	var visit func(key string) error
+	visit = func(key string) error {
+		if seen[key] {
+			return nil
+		}
+		seen[key] = true
+		lf, err := f.Load(ctx, key)
+		if err != nil {
+			return err
+		}
+		for _, bk := range lf.Data().Keys() {
+			blocks[bk] = struct{}{}
+		}
+		for _, kid := range file.Encode(lf).GetNode().Children {
+			if err := visit(string(kid.Key)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := visit(key); err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t.blocks = int64(len(blocks))
+	return t.blocks, nil
+}
+
+// treeXAttr returns the value of the tree statistic attr for the directory f.
+func (f *FS) treeXAttr(ctx context.Context, attr string) (int64, errno) {
+	if !f.file().Stat().Mode.IsDir() {
+		return 0, xattrErrnoNotFound
+	}
+	key, err := f.file().Flush(ctx)
+	if err != nil {
+		return 0, errorToErrno(err)
+	}
+	t, err := f.st.subtreeStats(ctx, f.file(), key)
+	if err != nil {
+		return 0, errorToErrno(err)
+	}
+	switch attr {
+	case ffsTreeBytes:
+		return t.bytes, noError
+	case ffsTreeFiles:
+		return t.files, noError
+	case ffsTreeDirs:
+		return t.dirs, noError
+	case ffsTreeUniqueBlocks:
+		n, err := f.st.uniqueBlocks(ctx, f.file(), key, t)
+		if err != nil {
+			return 0, errorToErrno(err)
+		}
+		return n, noError
+	default:
+		return 0, xattrErrnoNotFound
+	}
+}
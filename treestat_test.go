@@ -0,0 +1,164 @@
+// Copyright 2019 Michael J. Fromberger. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ffuse_test
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/creachadair/ffs/blob/memstore"
+	"github.com/creachadair/ffs/file"
+	"github.com/creachadair/ffs/filetree"
+	"github.com/creachadair/ffuse"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestTreeStats(t *testing.T) {
+	root, ctx := newTestFS(t)
+	check := func(want map[string]int64) {
+		t.Helper()
+		for attr, w := range want {
+			got, err := strconv.ParseInt(getXAttr(t, ctx, root, "ffs.tree."+attr), 10, 64)
+			if err != nil {
+				t.Errorf("Parse %s: %v", attr, err)
+			} else if got != w {
+				t.Errorf("ffs.tree.%s: got %d, want %d", attr, got, w)
+			}
+		}
+	}
+	check(map[string]int64{"bytes": 0, "files": 0, "dirs": 1, "uniqueBlocks": 0})
+
+	// Two identical files share their blocks.
+	big := strings.Repeat("0123456789abcdef", 4096)
+	sub := makeDir(t, ctx, root, "sub")
+	createFile(t, ctx, sub, "a", big)
+	createFile(t, ctx, sub, "b", big)
+	createFile(t, ctx, root, "c", "hello")
+	check(map[string]int64{"bytes": int64(2*len(big) + 5), "files": 3, "dirs": 2})
+	blocks, _ := strconv.ParseInt(getXAttr(t, ctx, root, "ffs.tree.uniqueBlocks"), 10, 64)
+	if blocks < 2 {
+		t.Errorf("uniqueBlocks: got %d, want at least 2", blocks)
+	}
+	if sb, _ := strconv.ParseInt(getXAttr(t, ctx, sub, "ffs.tree.uniqueBlocks"), 10, 64); sb != blocks-1 {
+		t.Errorf("uniqueBlocks of sub: got %d, want %d", sb, blocks-1)
+	}
+
+	// Changes below the root are reflected in the statistics of the root.
+	deep := makeDir(t, ctx, makeDir(t, ctx, sub, "x"), "y")
+	createFile(t, ctx, deep, "d", "world!")
+	check(map[string]int64{"bytes": int64(2*len(big) + 11), "files": 4, "dirs": 4})
+	if e := sub.Unlink(ctx, "a"); e != 0 {
+		t.Fatalf("Unlink: %v", e)
+	}
+	check(map[string]int64{"bytes": int64(len(big) + 11), "files": 3, "dirs": 4, "uniqueBlocks": blocks + 1})
+}
+
+func TestTreeStatsFile(t *testing.T) {
+	root, ctx := newTestFS(t)
+	f := createFile(t, ctx, root, "f", "data")
+	buf := make([]byte, 64)
+	if _, e := f.Getxattr(ctx, "ffs.tree.bytes", buf); e == 0 {
+		t.Error("Getxattr ffs.tree.bytes on a file: unexpectedly succeeded")
+	}
+}
+
+type fixedCapacity struct{ total, avail int64 }
+
+func (c fixedCapacity) Capacity(context.Context) (int64, int64, error) { return c.total, c.avail, nil }
+
+func TestStatfs(t *testing.T) {
+	root, ctx := newTestFS(t)
+	statfs := func() *fuse.StatfsOut {
+		t.Helper()
+		var out fuse.StatfsOut
+		if e := root.Statfs(ctx, &out); e != 0 {
+			t.Fatalf("Statfs: %v", e)
+		}
+		return &out
+	}
+
+	// Without a capacity, free space is unknown.
+	out := statfs()
+	if out.Files != 1 || out.Blocks != 0 {
+		t.Errorf("Statfs empty: got files=%d blocks=%d, want 1, 0", out.Files, out.Blocks)
+	}
+	if out.Bfree != ^uint64(0) || out.Bavail != ^uint64(0) {
+		t.Errorf("Statfs: got bfree=%d bavail=%d, want unknown", out.Bfree, out.Bavail)
+	}
+
+	// Usage follows changes to the tree, as of its last flush. Statfs does
+	// not flush the tree itself.
+	flush := func() { t.Helper(); getXAttr(t, ctx, root, "ffs.storageKey") }
+	sub := makeDir(t, ctx, root, "sub")
+	createFile(t, ctx, sub, "a", strings.Repeat("x", 10000))
+	if out := statfs(); out.Files != 1 || out.Blocks != 0 {
+		t.Errorf("Statfs before flush: got files=%d blocks=%d, want 1, 0", out.Files, out.Blocks)
+	}
+	flush()
+	if out := statfs(); out.Files != 3 || out.Blocks != 3 {
+		t.Errorf("Statfs: got files=%d blocks=%d, want 3, 3", out.Files, out.Blocks)
+	}
+
+	// A change below the root does not invalidate its storage key, and a
+	// change to the root does, but either way the last flush is reported.
+	createFile(t, ctx, sub, "b", "y")
+	createFile(t, ctx, root, "c", "")
+	if out := statfs(); out.Files != 3 || out.Blocks != 3 {
+		t.Errorf("Statfs before flush: got files=%d blocks=%d, want 3, 3", out.Files, out.Blocks)
+	}
+	flush()
+	if out := statfs(); out.Files != 5 || out.Blocks != 3 {
+		t.Errorf("Statfs: got files=%d blocks=%d, want 5, 3", out.Files, out.Blocks)
+	}
+	if e := sub.Unlink(ctx, "a"); e != 0 {
+		t.Fatalf("Unlink: %v", e)
+	}
+	flush()
+	if out := statfs(); out.Files != 4 || out.Blocks != 1 {
+		t.Errorf("Statfs: got files=%d blocks=%d, want 4, 1", out.Files, out.Blocks)
+	}
+}
+
+func TestLocalCapacity(t *testing.T) {
+	total, avail, err := ffuse.LocalCapacity(t.TempDir()).Capacity(t.Context())
+	if err != nil {
+		t.Fatalf("Capacity: %v", err)
+	}
+	if total <= 0 || avail < 0 || avail > total {
+		t.Errorf("Capacity: got total=%d avail=%d, want 0 <= avail <= total, total > 0", total, avail)
+	}
+	if _, _, err := ffuse.LocalCapacity("/nonesuch/path").Capacity(t.Context()); err == nil {
+		t.Error("Capacity of a missing path: unexpectedly succeeded")
+	}
+}
+
+func TestStatfsCapacity(t *testing.T) {
+	st, err := filetree.NewStore(t.Context(), memstore.New(nil))
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+	root := file.New(st.Files(), &file.NewOptions{Stat: &file.Stat{Mode: os.ModeDir | 0755}})
+	fsys := ffuse.New(root, &ffuse.Options{Store: st, Capacity: fixedCapacity{total: 1 << 20, avail: 1 << 18}})
+	var out fuse.StatfsOut
+	if e := fsys.Statfs(t.Context(), &out); e != 0 {
+		t.Fatalf("Statfs: %v", e)
+	}
+	if out.Blocks != 256 || out.Bfree != 64 || out.Bavail != 64 {
+		t.Errorf("Statfs: got blocks=%d bfree=%d bavail=%d, want 256, 64, 64", out.Blocks, out.Bfree, out.Bavail)
+	}
+}
@@ -21,8 +21,9 @@ import (
 // Symbolic constants for extended attributes, macOS version.
 // These are not exposed in the syscall package.
 const (
-	xattrCreate  = 2 // XATTR_CREATE for setxattr(2)
-	xattrReplace = 4 // XATTR_REPLACE for setxattr(2)
+	xattrCreate  = 2   // XATTR_CREATE for setxattr(2)
+	xattrReplace = 4   // XATTR_REPLACE for setxattr(2)
+	xattrNameMax = 127 // XATTR_MAXNAMELEN, the longest attribute name
 
 	// The errno returned for "xattr not found".
 	xattrErrnoNotFound = syscall.ENOATTR
@@ -21,8 +21,9 @@ import (
 // Symbolic constants for extended attributes, Linux version.
 // These are not exposed in the syscall package.
 const (
-	xattrCreate  = 1 // XATTR_CREATE for setxattr(2)
-	xattrReplace = 2 // XATTR_REPLACE for setxattr(2)
+	xattrCreate  = 1   // XATTR_CREATE for setxattr(2)
+	xattrReplace = 2   // XATTR_REPLACE for setxattr(2)
+	xattrNameMax = 255 // XATTR_NAME_MAX, the longest attribute name
 
 	// The errno returned for "xattr not found".
 	xattrErrnoNotFound = syscall.ENODATA
@@ -0,0 +1,318 @@
+// Copyright 2019 Michael J. Fromberger. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ffuse_test
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+
+	ffsroot "github.com/creachadair/ffs/file/root"
+	"github.com/creachadair/ffuse"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// listXAttrs returns the names of the extended attributes listed for node.
+func listXAttrs(t *testing.T, ctx context.Context, node *ffuse.FS) []string {
+	t.Helper()
+	buf := make([]byte, 1<<16)
+	n, e := node.Listxattr(ctx, buf)
+	if e != 0 {
+		t.Fatalf("Listxattr: %v", e)
+	}
+	return strings.Split(strings.TrimSuffix(string(buf[:n]), "\x00"), "\x00")
+}
+
+// lookup returns the node of the child name of dir.
+func lookup(t *testing.T, ctx context.Context, dir *ffuse.FS, name string) *ffuse.FS {
+	t.Helper()
+	in, e := dir.Lookup(ctx, name, new(fuse.EntryOut))
+	if e != 0 {
+		t.Fatalf("Lookup %q: %v", name, e)
+	}
+	return in.Operations().(*ffuse.FS)
+}
+
+func TestListVirtualXAttrs(t *testing.T) {
+	root, ctx := newTestFSOptions(t, &ffuse.Options{ListVirtualXAttrs: true})
+	sub := makeDir(t, ctx, root, "sub")
+	f := createFile(t, ctx, sub, "f", "data")
+	if e := f.Setxattr(ctx, "user.note", []byte("hi"), 0); e != 0 {
+		t.Fatalf("Setxattr: %v", e)
+	}
+
+	fileAttrs := listXAttrs(t, ctx, f)
+	for _, want := range []string{"user.note", "ffs.dataHash", "ffs.dataHash.hex", "ffs.blockCount"} {
+		if !slices.Contains(fileAttrs, want) {
+			t.Errorf("File attributes %q: missing %q", fileAttrs, want)
+		}
+	}
+
+	// The links of a directory are listed in their raw form, and can be read.
+	createFile(t, ctx, sub, "g.hex", "more")
+	dirAttrs := listXAttrs(t, ctx, sub)
+	var links []string
+	for _, name := range dirAttrs {
+		if strings.HasPrefix(name, "ffs.link.") {
+			links = append(links, name)
+			getXAttr(t, ctx, sub, name)
+		}
+	}
+	if want := []string{"ffs.link.f", "ffs.link.g.hex"}; !slices.Equal(links, want) {
+		t.Errorf("Directory links: got %q, want %q", links, want)
+	}
+
+	// Attributes that flush or scan the tree are not listed.
+	for _, attrs := range [][]string{fileAttrs, dirAttrs} {
+		for _, name := range attrs {
+			if strings.HasPrefix(name, "ffs.storageKey") || strings.HasPrefix(name, "ffs.tree.") ||
+				strings.HasPrefix(name, "ffs.blocks") {
+				t.Errorf("Unexpected attribute %q listed", name)
+			}
+		}
+	}
+
+	// The links of a large directory are not listed.
+	big := makeDir(t, ctx, root, "big")
+	for i := range 300 {
+		createFile(t, ctx, big, fmt.Sprintf("f%03d", i), "")
+	}
+	for _, name := range listXAttrs(t, ctx, big) {
+		if strings.HasPrefix(name, "ffs.link.") {
+			t.Errorf("Large directory: unexpected attribute %q listed", name)
+			break
+		}
+	}
+
+	// Without the option, only stored attributes are listed.
+	plain, ctx := newTestFS(t)
+	g := createFile(t, ctx, plain, "g", "data")
+	if got := listXAttrs(t, ctx, g); len(got) != 1 || got[0] != "" {
+		t.Errorf("Listxattr without option: got %q, want none", got)
+	}
+}
+
+func TestLinkXAttrRoundTrip(t *testing.T) {
+	root, ctx := newTestFS(t)
+	createFile(t, ctx, root, "a", "apple")
+	createFile(t, ctx, root, "x", "xylophone")
+	wantHash := getXAttr(t, ctx, lookup(t, ctx, root, "a"), "ffs.dataHash.hex")
+
+	// The raw key can be copied to a new name, and reads of the key accept
+	// the encoding suffixes of the other "ffs.*" attributes.
+	key := getXAttr(t, ctx, root, "ffs.link.a")
+	if e := root.Setxattr(ctx, "ffs.link.copy", []byte(key), 0); e != 0 {
+		t.Fatalf("Setxattr ffs.link.copy: %v", e)
+	}
+	if got := getXAttr(t, ctx, lookup(t, ctx, root, "copy"), "ffs.dataHash.hex"); got != wantHash {
+		t.Errorf("Copy: data hash %q, want %q", got, wantHash)
+	}
+	if got, err := hex.DecodeString(getXAttr(t, ctx, root, "ffs.link.a.hex")); err != nil || string(got) != key {
+		t.Errorf("ffs.link.a.hex: got %x, %v; want %x", got, err, key)
+	}
+	if got, err := base64.StdEncoding.DecodeString(getXAttr(t, ctx, root, "ffs.link.a.b64")); err != nil || string(got) != key {
+		t.Errorf("ffs.link.a.b64: got %x, %v; want %x", got, err, key)
+	}
+
+	// Setting and removing a link name the child literally, even with a
+	// suffix, and the value set is the raw key.
+	if e := root.Setxattr(ctx, "ffs.link.x.hex", []byte(key), 0); e != 0 {
+		t.Fatalf("Setxattr ffs.link.x.hex: %v", e)
+	}
+	if got := getXAttr(t, ctx, lookup(t, ctx, root, "x.hex"), "ffs.dataHash.hex"); got != wantHash {
+		t.Errorf("Child x.hex: data hash %q, want %q", got, wantHash)
+	}
+	if got := readFile(t, ctx, lookup(t, ctx, root, "x")); got != "xylophone" {
+		t.Errorf("Child x: got %q, want unchanged", got)
+	}
+
+	// A read of a name with a suffix prefers a child with that name.
+	if got := getXAttr(t, ctx, root, "ffs.link.x.hex"); got != key {
+		t.Errorf("ffs.link.x.hex: got %x, want the raw key %x", got, key)
+	}
+
+	if e := root.Removexattr(ctx, "ffs.link.x.hex"); e != 0 {
+		t.Fatalf("Removexattr ffs.link.x.hex: %v", e)
+	}
+	if _, e := root.Lookup(ctx, "x.hex", new(fuse.EntryOut)); e != syscall.ENOENT {
+		t.Errorf("Lookup x.hex after remove: got %v, want %v", e, syscall.ENOENT)
+	}
+	if got := readFile(t, ctx, lookup(t, ctx, root, "x")); got != "xylophone" {
+		t.Errorf("Child x after removing x.hex: got %q, want unchanged", got)
+	}
+	if e := root.Removexattr(ctx, "ffs.link.a.b64"); e != syscall.Errno(fuse.ENOATTR) {
+		t.Errorf("Removexattr ffs.link.a.b64: got %v, want %v", e, syscall.Errno(fuse.ENOATTR))
+	}
+}
+
+func TestLinksBatch(t *testing.T) {
+	root, ctx := newTestFS(t)
+	createFile(t, ctx, root, "a", "apple")
+	createFile(t, ctx, root, "b", "banana")
+	akey := getXAttr(t, ctx, root, "ffs.link.a.hex")
+	before := getXAttr(t, ctx, root, "ffs.storageKey.hex")
+
+	// A batch with any invalid edit changes nothing.
+	for _, tc := range []struct {
+		batch string
+		want  syscall.Errno
+	}{
+		{akey + " c\n" + "zz d\n", syscall.EINVAL},                    // bad key
+		{akey + " c\n" + akey + " c\n", syscall.EINVAL},               // duplicate name
+		{akey + " c\n" + "- nonesuch\n", syscall.Errno(fuse.ENOATTR)}, // unlink missing
+		{"- b\n" + strings.Repeat("0", 64) + " c\n", syscall.ENOENT},  // unknown key
+	} {
+		if e := root.Setxattr(ctx, "ffs.links", []byte(tc.batch), 0); e != tc.want {
+			t.Errorf("Setxattr ffs.links %q: got %v, want %v", tc.batch, e, tc.want)
+		}
+		if got := getXAttr(t, ctx, root, "ffs.storageKey.hex"); got != before {
+			t.Errorf("Directory changed after failed batch %q", tc.batch)
+		}
+	}
+
+	// A valid batch applies all its edits.
+	if e := root.Setxattr(ctx, "ffs.links", []byte(akey+" c\n- b\n"), 0); e != 0 {
+		t.Fatalf("Setxattr ffs.links: %v", e)
+	}
+	if got := getXAttr(t, ctx, root, "ffs.link.c.hex"); got != akey {
+		t.Errorf("Storage key of c: got %q, want %q", got, akey)
+	}
+	if _, e := root.Lookup(ctx, "b", new(fuse.EntryOut)); e != syscall.ENOENT {
+		t.Errorf("Lookup b: got %v, want %v", e, syscall.ENOENT)
+	}
+}
+
+// Flags for Setxattr, from setxattr(2).
+const (
+	xattrCreate  = 0x1 // XATTR_CREATE
+	xattrReplace = 0x2 // XATTR_REPLACE
+)
+
+func TestRootLinkXAttr(t *testing.T) {
+	opts := new(ffuse.Options)
+	root, ctx := newTestFSOptions(t, opts)
+	src := makeDir(t, ctx, root, "src")
+	createFile(t, ctx, src, "x", "hello")
+	key := getXAttr(t, ctx, src, "ffs.storageKey")
+	if err := ffsroot.New(opts.Store.Roots(), &ffsroot.Options{FileKey: key}).Save(ctx, "saved"); err != nil {
+		t.Fatalf("Save root: %v", err)
+	}
+
+	// A root pointer, optionally followed by a path, names a file to link.
+	for _, tc := range []struct {
+		name, spec string
+		want       syscall.Errno
+	}{
+		{"tree", "saved", 0},
+		{"one", "saved:x", 0},
+		{"nonesuch", "nonesuch", syscall.ENOENT},
+		{"badpath", "saved:nonesuch", syscall.ENOENT},
+	} {
+		if e := root.Setxattr(ctx, "ffs.root."+tc.name, []byte(tc.spec), 0); e != tc.want {
+			t.Errorf("Setxattr ffs.root.%s %q: got %v, want %v", tc.name, tc.spec, e, tc.want)
+		}
+	}
+	tx := lookup(t, ctx, lookup(t, ctx, root, "tree"), "x")
+	if got := readFile(t, ctx, tx); got != "hello" {
+		t.Errorf("tree/x: got %q, want hello", got)
+	}
+	if got := readFile(t, ctx, lookup(t, ctx, root, "one")); got != "hello" {
+		t.Errorf("one: got %q, want hello", got)
+	}
+
+	// The linked file is a copy, independent of the original.
+	if _, e := openFile(t, ctx, tx, syscall.O_WRONLY).(fs.FileWriter).Write(ctx, []byte("J"), 0); e != 0 {
+		t.Fatalf("Write tree/x: %v", e)
+	}
+	if got := readFile(t, ctx, lookup(t, ctx, src, "x")); got != "hello" {
+		t.Errorf("src/x after writing the copy: got %q, want hello", got)
+	}
+
+	// The flags of the request govern replacing an existing name, and only a
+	// directory may link files.
+	if e := root.Setxattr(ctx, "ffs.root.one", []byte("saved"), xattrCreate); e != syscall.EEXIST {
+		t.Errorf("Setxattr ffs.root.one with XATTR_CREATE: got %v, want %v", e, syscall.EEXIST)
+	}
+	if e := root.Setxattr(ctx, "ffs.root.one", []byte("saved"), 0); e != 0 {
+		t.Errorf("Setxattr ffs.root.one to replace it: %v", e)
+	} else if got := lookup(t, ctx, root, "one"); getAttr(t, ctx, got).Mode&syscall.S_IFMT != syscall.S_IFDIR {
+		t.Error("After replacing one: not a directory")
+	}
+	if e := tx.Setxattr(ctx, "ffs.root.y", []byte("saved"), 0); e != syscall.EPERM {
+		t.Errorf("Setxattr ffs.root.y on a file: got %v, want %v", e, syscall.EPERM)
+	}
+}
+
+func TestSnapshotXAttr(t *testing.T) {
+	opts := new(ffuse.Options)
+	root, ctx := newTestFSOptions(t, opts)
+	dir := makeDir(t, ctx, root, "dir")
+	f := createFile(t, ctx, dir, "x", "hello")
+
+	// A snapshot writes a root pointer for the directory, with the
+	// description given after the name.
+	if e := dir.Setxattr(ctx, "ffs.snapshot", []byte("jobs/out Nightly output"), 0); e != 0 {
+		t.Fatalf("Setxattr ffs.snapshot: %v", e)
+	}
+	rp, err := ffsroot.Open(ctx, opts.Store.Roots(), "jobs/out")
+	if err != nil {
+		t.Fatalf("Open root: %v", err)
+	}
+	if rp.Description != "Nightly output" {
+		t.Errorf("Description: got %q, want %q", rp.Description, "Nightly output")
+	}
+	if want := getXAttr(t, ctx, dir, "ffs.storageKey"); rp.FileKey != want {
+		t.Errorf("Root file key: got %x, want %x", rp.FileKey, want)
+	}
+
+	// The flags of the request govern replacing an existing root.
+	for _, tc := range []struct {
+		value string
+		flags uint32
+		want  syscall.Errno
+	}{
+		{"jobs/out", xattrCreate, syscall.EEXIST},
+		{"jobs/new", xattrReplace, syscall.Errno(fuse.ENOATTR)},
+		{"", 0, syscall.EINVAL},
+		{"jobs/new", xattrCreate, 0},
+	} {
+		if e := dir.Setxattr(ctx, "ffs.snapshot", []byte(tc.value), tc.flags); e != tc.want {
+			t.Errorf("Setxattr ffs.snapshot %q flags %#x: got %v, want %v", tc.value, tc.flags, e, tc.want)
+		}
+	}
+
+	// Replacing a root records the current state of the directory.
+	createFile(t, ctx, dir, "y", "world")
+	if e := dir.Setxattr(ctx, "ffs.snapshot", []byte("jobs/out"), xattrReplace); e != 0 {
+		t.Fatalf("Setxattr ffs.snapshot to replace: %v", e)
+	}
+	if e := root.Setxattr(ctx, "ffs.root.copy", []byte("jobs/out:y"), 0); e != 0 {
+		t.Fatalf("Setxattr ffs.root.copy: %v", e)
+	}
+	if got := readFile(t, ctx, lookup(t, ctx, root, "copy")); got != "world" {
+		t.Errorf("Snapshot file y: got %q, want world", got)
+	}
+
+	// Only a directory may be snapshotted.
+	if e := f.Setxattr(ctx, "ffs.snapshot", []byte("file"), 0); e != syscall.EPERM {
+		t.Errorf("Setxattr ffs.snapshot on a file: got %v, want %v", e, syscall.EPERM)
+	}
+}